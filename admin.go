@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+func startAdminServer(config *config.Config, proxy *reloadableHandler) {
+	if !config.ConfigFile.Admin.Enabled {
+		return
+	}
+
+	go func() {
+		admin := echo.New()
+		admin.HideBanner = true
+		admin.HidePort = true
+
+		admin.GET("/bans", func(c echo.Context) error {
+			list, err := config.Bans.List(c.Request().Context())
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"success": false,
+					"message": "Unable to list bans",
+				})
+			}
+			return c.JSON(http.StatusOK, list)
+		})
+
+		admin.DELETE("/bans/:ip", func(c echo.Context) error {
+			ip := c.Param("ip")
+			found, err := config.Bans.Unban(c.Request().Context(), ip)
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{
+					"success": false,
+					"message": "Unable to revoke ban",
+				})
+			}
+			if !found {
+				return c.JSON(http.StatusNotFound, echo.Map{
+					"success": false,
+					"message": "IP " + ip + " is not banned",
+				})
+			}
+
+			config.Logger.Info().Str("ip", ip).Msg("ip unbanned")
+			return c.JSON(http.StatusOK, echo.Map{
+				"success": true,
+			})
+		})
+
+		admin.POST("/reload", func(c echo.Context) error {
+			if err := proxy.Reload("admin"); err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"success": false,
+					"message": err.Error(),
+				})
+			}
+			return c.JSON(http.StatusOK, echo.Map{
+				"success": true,
+			})
+		})
+
+		if err := admin.Start(config.ConfigFile.Admin.Host); err != nil && err != http.ErrServerClosed {
+			admin.Logger.Fatal(err)
+		}
+	}()
+}
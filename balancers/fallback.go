@@ -0,0 +1,183 @@
+package balancers
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/marigold-dev/tzproxy/breaker"
+	"github.com/marigold-dev/tzproxy/nodes"
+)
+
+// Fallback is a node the retries are sent to.
+type Fallback struct {
+	Target *middleware.ProxyTarget
+	Weight int
+}
+
+// FallbackPool picks the targets of the retries and hedged requests. The
+// fallbacks are tried in order, or at random in proportion to their weights
+// when any of them has one.
+type FallbackPool struct {
+	mutex     sync.Mutex
+	fallbacks []Fallback
+	weighted  bool
+	targets   []*middleware.ProxyTarget
+	random    *rand.Rand
+	breakers  *breaker.Set
+	heads     *nodes.HeadTracker
+	chains    *nodes.ChainChecker
+}
+
+func NewFallbackPool(fallbacks []Fallback, targets []*middleware.ProxyTarget, breakers *breaker.Set, heads *nodes.HeadTracker, chains *nodes.ChainChecker) *FallbackPool {
+	p := FallbackPool{}
+	p.fallbacks = fallbacks
+	for _, fallback := range fallbacks {
+		if fallback.Weight > 0 {
+			p.weighted = true
+		}
+	}
+	p.targets = targets
+	p.random = rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
+	p.breakers = breakers
+	p.heads = heads
+	p.chains = chains
+	return &p
+}
+
+// Len returns the number of fallbacks.
+func (p *FallbackPool) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.fallbacks)
+}
+
+// Next returns a target that wasn't attempted yet for the request, keeping
+// the ones whose circuit breaker is open or whose head is below minLevel for
+// last. Fallbacks come first, then the primary targets unless fallbackOnly
+// is set. Targets on the wrong chain are never returned. It returns nil when
+// every target was attempted.
+func (p *FallbackPool) Next(attempted []string, fallbackOnly bool, minLevel int64) *middleware.ProxyTarget {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	untried := func(target *middleware.ProxyTarget) bool {
+		return !contains(attempted, target.URL.Host) && p.chains.Allow(target.URL.Host)
+	}
+	healthy := func(target *middleware.ProxyTarget) bool {
+		return untried(target) && !p.heads.Behind(target.URL.Host, minLevel) &&
+			p.breakers.Allow(target.URL.Host)
+	}
+	for _, available := range []func(*middleware.ProxyTarget) bool{healthy, untried} {
+		if target := p.fallback(available); target != nil {
+			return target
+		}
+		if fallbackOnly {
+			continue
+		}
+		for _, i := range p.random.Perm(len(p.targets)) {
+			if available(p.targets[i]) {
+				return p.targets[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Alternative returns a primary target other than the attempted ones whose
+// circuit breaker allows requests, whose head reached minLevel and that is
+// on the expected chain, or nil when there is none.
+func (p *FallbackPool) Alternative(attempted []string, minLevel int64) *middleware.ProxyTarget {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, i := range p.random.Perm(len(p.targets)) {
+		host := p.targets[i].URL.Host
+		if !contains(attempted, host) && p.chains.Allow(host) &&
+			!p.heads.Behind(host, minLevel) && p.breakers.Allow(host) {
+			return p.targets[i]
+		}
+	}
+	return nil
+}
+
+// Reached reports whether a primary target is known to have reached level,
+// and can be picked: it is on the expected chain and its circuit breaker is
+// closed.
+func (p *FallbackPool) Reached(level int64) bool {
+	if p == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, target := range p.targets {
+		host := target.URL.Host
+		if head, ok := p.heads.Head(host); ok && head.Level >= level &&
+			p.chains.Allow(host) && p.breakers.State(host) == breaker.Closed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *FallbackPool) fallback(available func(*middleware.ProxyTarget) bool) *middleware.ProxyTarget {
+	for _, i := range p.order() {
+		if available(p.fallbacks[i].Target) {
+			return p.fallbacks[i].Target
+		}
+	}
+	return nil
+}
+
+// order returns the indexes of the fallbacks in the order they are tried:
+// the configured one, or a random one drawn by weight.
+func (p *FallbackPool) order() []int {
+	order := make([]int, 0, len(p.fallbacks))
+	left := make([]int, 0, len(p.fallbacks))
+	total := 0
+	for i := range p.fallbacks {
+		if !p.weighted {
+			order = append(order, i)
+			continue
+		}
+		left = append(left, i)
+		total += p.weight(i)
+	}
+
+	for len(left) > 0 {
+		n := p.random.Intn(total)
+		for j, i := range left {
+			if n < p.weight(i) {
+				order = append(order, i)
+				total -= p.weight(i)
+				left = append(left[:j], left[j+1:]...)
+				break
+			}
+			n -= p.weight(i)
+		}
+	}
+	return order
+}
+
+// weight returns the weight of a fallback, one when it has none.
+func (p *FallbackPool) weight(i int) int {
+	return max(p.fallbacks[i].Weight, 1)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
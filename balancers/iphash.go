@@ -1,6 +1,7 @@
 package balancers
 
 import (
+	"errors"
 	"math/rand"
 	"sync"
 	"time"
@@ -8,23 +9,37 @@ import (
 	echocache "github.com/fraidev/go-echo-cache"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/marigold-dev/tzproxy/breaker"
+	"github.com/marigold-dev/tzproxy/nodes"
 )
 
+// ErrNoTarget is returned when no target can serve the request.
+var ErrNoTarget = errors.New("no target available")
+
 type ipHashBalancer struct {
-	targets     []*middleware.ProxyTarget
-	retryTarget *middleware.ProxyTarget
-	mutex       sync.Mutex
-	random      *rand.Rand
-	store       echocache.Cache
-	TTL         int
+	targets  []*middleware.ProxyTarget
+	mutex    sync.Mutex
+	random   *rand.Rand
+	store    echocache.Cache
+	breakers *breaker.Set
+	heads    *nodes.HeadTracker
+	chains   *nodes.ChainChecker
+	TTL      int
 }
 
-func NewIPHashBalancer(targets []*middleware.ProxyTarget, retryTarget *middleware.ProxyTarget, ttl int, store echocache.Cache) middleware.ProxyBalancer {
+// NewIPHashBalancer sticks each client to a target for ttl seconds. Targets
+// whose circuit breaker is open are skipped, unless they all are, and so are
+// the targets whose head is below the level set in the min_level context
+// key. Targets on the wrong chain are never used. A retry goes to the target
+// set in the retry context key.
+func NewIPHashBalancer(targets []*middleware.ProxyTarget, ttl int, store echocache.Cache, breakers *breaker.Set, heads *nodes.HeadTracker, chains *nodes.ChainChecker) middleware.ProxyBalancer {
 	b := ipHashBalancer{}
 	b.targets = targets
-	b.retryTarget = retryTarget
 	b.random = rand.New(rand.NewSource(int64(time.Now().Nanosecond())))
 	b.store = store
+	b.breakers = breakers
+	b.heads = heads
+	b.chains = chains
 	b.TTL = ttl
 	return &b
 }
@@ -53,28 +68,77 @@ func (b *ipHashBalancer) RemoveTarget(name string) bool {
 	return false
 }
 
+// NextTarget returns the target of the request, or ErrNoTarget when there is
+// none. It lets ProxyWithConfig report the error instead of using a nil
+// target.
+func (b *ipHashBalancer) NextTarget(c echo.Context) (*middleware.ProxyTarget, error) {
+	if target := b.Next(c); target != nil {
+		return target, nil
+	}
+	return nil, ErrNoTarget
+}
+
+// Next returns the target of the request, or nil when every target is on
+// the wrong chain.
 func (b *ipHashBalancer) Next(c echo.Context) *middleware.ProxyTarget {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
+	if target, ok := c.Get("retry").(*middleware.ProxyTarget); ok {
+		return target
+	}
+
 	if len(b.targets) == 0 {
 		return nil
-	} else if len(b.targets) == 1 && b.retryTarget == nil {
+	} else if len(b.targets) == 1 {
+		if !b.chains.Allow(b.targets[0].URL.Host) {
+			return nil
+		}
 		return b.targets[0]
 	}
 
-	if c.Get("retry") != nil {
-		return b.retryTarget
-	}
-
+	minLevel, _ := c.Get("min_level").(int64)
 	ctx := c.Request().Context()
 	ip := []byte(c.RealIP())
 	got, err := b.store.Get(ctx, ip)
-	if err != nil {
-		i := b.random.Intn(len(b.targets))
-		b.store.Set(ctx, ip, []byte{byte(i)}, b.TTL)
-		return b.targets[i]
+	// The stored index can be stale when the targets changed on reload
+	if err == nil && len(got) > 0 && int(got[0]) < len(b.targets) &&
+		b.chains.Allow(b.targets[got[0]].URL.Host) &&
+		!b.heads.Behind(b.targets[got[0]].URL.Host, minLevel) &&
+		b.breakers.Allow(b.targets[got[0]].URL.Host) {
+		return b.targets[int(got[0])]
 	}
 
-	return b.targets[int(got[0])]
+	i := b.pick(minLevel)
+	if i < 0 {
+		return nil
+	}
+	b.store.Set(ctx, ip, []byte{byte(i)}, b.TTL)
+	return b.targets[i]
+}
+
+// pick returns a random target that reached minLevel and is allowed by its
+// circuit breaker, then one allowed by its circuit breaker, or any target
+// when none is. Only the targets on the expected chain are picked, and it
+// returns -1 when there is none.
+func (b *ipHashBalancer) pick(minLevel int64) int {
+	order := b.random.Perm(len(b.targets))
+	for _, i := range order {
+		host := b.targets[i].URL.Host
+		if b.chains.Allow(host) && !b.heads.Behind(host, minLevel) && b.breakers.Allow(host) {
+			return i
+		}
+	}
+	for _, i := range order {
+		host := b.targets[i].URL.Host
+		if b.chains.Allow(host) && b.breakers.Allow(host) {
+			return i
+		}
+	}
+	for _, i := range order {
+		if b.chains.Allow(b.targets[i].URL.Host) {
+			return i
+		}
+	}
+	return -1
 }
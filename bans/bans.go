@@ -0,0 +1,32 @@
+package bans
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	ReasonForbidden    = "forbidden"
+	ReasonRateLimited  = "rate_limited"
+	ReasonBadInjection = "bad_injection"
+	ReasonManual       = "manual"
+)
+
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// Store keeps offense counters and active bans. Implementations must be
+// safe for concurrent use.
+type Store interface {
+	// Hit records an offense for ip and returns how many were recorded for
+	// the same reason within the current window.
+	Hit(ctx context.Context, ip, reason string, window time.Duration) (int64, error)
+	Ban(ctx context.Context, ban Ban) error
+	// Get returns the active ban for ip, or nil if there is none.
+	Get(ctx context.Context, ip string) (*Ban, error)
+	Unban(ctx context.Context, ip string) (bool, error)
+	List(ctx context.Context) ([]Ban, error)
+}
@@ -0,0 +1,108 @@
+package bans
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mutex sync.Mutex
+	hits  map[string]*counter
+	bans  map[string]Ban
+}
+
+type counter struct {
+	count   int64
+	expires time.Time
+}
+
+func NewMemoryStore() Store {
+	s := &memoryStore{
+		hits: make(map[string]*counter),
+		bans: make(map[string]Ban),
+	}
+	go s.cleanup(time.Minute)
+	return s
+}
+
+func (s *memoryStore) Hit(ctx context.Context, ip, reason string, window time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	key := reason + "|" + ip
+	c, has := s.hits[key]
+	if !has || now.After(c.expires) {
+		c = &counter{expires: now.Add(window)}
+		s.hits[key] = c
+	}
+	c.count++
+	return c.count, nil
+}
+
+func (s *memoryStore) Ban(ctx context.Context, ban Ban) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bans[ban.IP] = ban
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, ip string) (*Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ban, has := s.bans[ip]
+	if !has {
+		return nil, nil
+	}
+	if time.Now().After(ban.Until) {
+		delete(s.bans, ip)
+		return nil, nil
+	}
+	return &ban, nil
+}
+
+func (s *memoryStore) Unban(ctx context.Context, ip string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, has := s.bans[ip]
+	delete(s.bans, ip)
+	return has, nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Ban, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	list := []Ban{}
+	for _, ban := range s.bans {
+		if now.Before(ban.Until) {
+			list = append(list, ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list, nil
+}
+
+// cleanup drops expired counters and bans so the maps don't grow forever.
+func (s *memoryStore) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		now := time.Now()
+		for key, c := range s.hits {
+			if now.After(c.expires) {
+				delete(s.hits, key)
+			}
+		}
+		for ip, ban := range s.bans {
+			if now.After(ban.Until) {
+				delete(s.bans, ip)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
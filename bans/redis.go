@@ -0,0 +1,92 @@
+package bans
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	banPrefix = "tzproxy:ban:"
+	hitPrefix = "tzproxy:ban_hits:"
+)
+
+// redisStore shares bans between every replica using the same redis.
+type redisStore struct {
+	client *redis.Client
+}
+
+func NewRedisStore(client *redis.Client) Store {
+	return &redisStore{client: client}
+}
+
+// hitScript counts a hit and starts the window on the first one, in a
+// single step so that the counter can't be left without an expiry.
+var hitScript = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return count
+`)
+
+func (s *redisStore) Hit(ctx context.Context, ip, reason string, window time.Duration) (int64, error) {
+	key := hitPrefix + reason + ":" + ip
+	return hitScript.Run(ctx, s.client, []string{key}, window.Milliseconds()).Int64()
+}
+
+func (s *redisStore) Ban(ctx context.Context, ban Ban) error {
+	value, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, banPrefix+ban.IP, value, time.Until(ban.Until)).Err()
+}
+
+func (s *redisStore) Get(ctx context.Context, ip string) (*Ban, error) {
+	value, err := s.client.Get(ctx, banPrefix+ip).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ban Ban
+	if err := json.Unmarshal(value, &ban); err != nil {
+		return nil, err
+	}
+	return &ban, nil
+}
+
+func (s *redisStore) Unban(ctx context.Context, ip string) (bool, error) {
+	deleted, err := s.client.Del(ctx, banPrefix+ip).Result()
+	return deleted > 0, err
+}
+
+func (s *redisStore) List(ctx context.Context) ([]Ban, error) {
+	list := []Ban{}
+	iter := s.client.Scan(ctx, 0, banPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		value, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var ban Ban
+		if err := json.Unmarshal(value, &ban); err != nil {
+			return nil, err
+		}
+		list = append(list, ban)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list, nil
+}
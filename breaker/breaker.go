@@ -0,0 +1,227 @@
+package breaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/rs/zerolog"
+)
+
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+type Settings struct {
+	// Window is the period over which the error and slow rates are computed.
+	Window time.Duration
+	// MinRequests is the number of requests in a window before it can trip.
+	MinRequests int
+	// ErrorRate is the rate of failed requests, from 0 to 1, that trips it.
+	ErrorRate float64
+	// SlowThreshold is the latency above which a request counts as slow.
+	SlowThreshold time.Duration
+	// SlowRate is the rate of slow requests that trips it, 0 to disable it.
+	SlowRate float64
+	// OpenTimeout is how long it stays open before letting probes through.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of successful probes needed to close.
+	HalfOpenRequests int
+}
+
+// Set holds one circuit breaker per upstream host. A nil Set allows every
+// request.
+type Set struct {
+	mutex    sync.Mutex
+	settings Settings
+	breakers map[string]*breaker
+	logger   zerolog.Logger
+}
+
+type breaker struct {
+	state       State
+	windowStart time.Time
+	requests    int
+	failures    int
+	slow        int
+	openedAt    time.Time
+	probes      int
+	probedAt    time.Time
+	successes   int
+}
+
+func NewSet(settings Settings, logger zerolog.Logger) *Set {
+	return &Set{
+		settings: settings,
+		breakers: make(map[string]*breaker),
+		logger:   logger,
+	}
+}
+
+// Configure replaces the settings, keeping the current states.
+func (s *Set) Configure(settings Settings) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.settings = settings
+}
+
+// Allow reports whether a request can be sent to host. An open breaker
+// becomes half-open after its timeout, and then lets a limited number of
+// probes through. Probes that are neither recorded nor released within the
+// open timeout are taken as lost, so that they can't hold the breaker
+// half-open forever.
+func (s *Set) Allow(host string) bool {
+	if s == nil {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.get(host)
+	switch b.state {
+	case Open:
+		if time.Since(b.openedAt) < s.settings.OpenTimeout {
+			return false
+		}
+		s.transition(host, b, HalfOpen)
+		fallthrough
+	case HalfOpen:
+		if b.probes >= s.settings.HalfOpenRequests {
+			if time.Since(b.probedAt) < s.settings.OpenTimeout {
+				return false
+			}
+			b.probes = 0
+		}
+		b.probes++
+		b.probedAt = time.Now()
+	}
+	return true
+}
+
+// Release frees the probe taken by Allow for a request whose outcome isn't
+// recorded, such as a request canceled by the client or by a hedge.
+func (s *Set) Release(host string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.get(host)
+	if b.state == HalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+// Record reports the outcome of a request sent to host.
+func (s *Set) Record(host string, failed bool, latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.get(host)
+	slow := s.settings.SlowThreshold > 0 && latency > s.settings.SlowThreshold
+	switch b.state {
+	case Closed:
+		now := time.Now()
+		if now.Sub(b.windowStart) > s.settings.Window {
+			b.windowStart = now
+			b.requests, b.failures, b.slow = 0, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		if b.requests >= s.settings.MinRequests && s.tripped(b) {
+			s.transition(host, b, Open)
+		}
+	case HalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		if failed || (slow && s.settings.SlowRate > 0) {
+			s.transition(host, b, Open)
+			return
+		}
+		b.successes++
+		if b.successes >= s.settings.HalfOpenRequests {
+			s.transition(host, b, Closed)
+		}
+	}
+}
+
+// State returns the current state of the breaker of host.
+func (s *Set) State(host string) State {
+	if s == nil {
+		return Closed
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(host).state
+}
+
+func (s *Set) tripped(b *breaker) bool {
+	requests := float64(b.requests)
+	if s.settings.ErrorRate > 0 && float64(b.failures)/requests >= s.settings.ErrorRate {
+		return true
+	}
+	return s.settings.SlowRate > 0 && float64(b.slow)/requests >= s.settings.SlowRate
+}
+
+func (s *Set) get(host string) *breaker {
+	b, has := s.breakers[host]
+	if !has {
+		b = &breaker{windowStart: time.Now()}
+		s.breakers[host] = b
+		metrics.CircuitBreakerState.WithLabelValues(host).Set(float64(Closed))
+	}
+	return b
+}
+
+func (s *Set) transition(host string, b *breaker, state State) {
+	event := s.logger.Info()
+	if state == Open {
+		event = s.logger.Warn()
+	}
+	event.
+		Str("target", host).
+		Str("from", b.state.String()).
+		Str("to", state.String()).
+		Int("requests", b.requests).
+		Int("failures", b.failures).
+		Int("slow", b.slow).
+		Msg("circuit breaker state changed")
+
+	b.state = state
+	b.probes, b.successes = 0, 0
+	switch state {
+	case Open:
+		b.openedAt = time.Now()
+	case Closed:
+		b.windowStart = time.Now()
+		b.requests, b.failures, b.slow = 0, 0, 0
+	}
+
+	metrics.CircuitBreakerState.WithLabelValues(host).Set(float64(state))
+	metrics.CircuitBreakerTransitions.WithLabelValues(host, state.String()).Inc()
+}
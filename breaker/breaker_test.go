@@ -0,0 +1,197 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const openTimeout = 20 * time.Millisecond
+
+type action int
+
+const (
+	allow action = iota
+	succeed
+	fail
+	slow
+	release
+	wait
+)
+
+type step struct {
+	action action
+	// allowed is the result expected from allow
+	allowed bool
+	// state is the state expected after the step
+	state State
+}
+
+// trip opens the breaker with failed requests.
+var trip = []step{
+	{action: fail, state: Closed},
+	{action: fail, state: Closed},
+	{action: fail, state: Closed},
+	{action: fail, state: Open},
+}
+
+func TestSet(t *testing.T) {
+	settings := Settings{
+		Window:           time.Hour,
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		SlowThreshold:    100 * time.Millisecond,
+		SlowRate:         0.5,
+		OpenTimeout:      openTimeout,
+		HalfOpenRequests: 2,
+	}
+
+	tests := []struct {
+		name  string
+		steps [][]step
+	}{
+		{"closed under the minimum requests", [][]step{{
+			{action: fail, state: Closed},
+			{action: fail, state: Closed},
+			{action: fail, state: Closed},
+			{action: allow, allowed: true, state: Closed},
+		}}},
+		{"closed under the error rate", [][]step{{
+			{action: fail, state: Closed},
+			{action: succeed, state: Closed},
+			{action: succeed, state: Closed},
+			{action: succeed, state: Closed},
+		}}},
+		{"opened by failures", [][]step{trip, {
+			{action: allow, allowed: false, state: Open},
+		}}},
+		{"opened by slow requests", [][]step{{
+			{action: slow, state: Closed},
+			{action: succeed, state: Closed},
+			{action: slow, state: Closed},
+			{action: succeed, state: Open},
+			{action: allow, allowed: false, state: Open},
+		}}},
+		{"half-open after the open timeout", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+		}}},
+		{"closed by successful probes", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: succeed, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: succeed, state: Closed},
+			{action: allow, allowed: true, state: Closed},
+		}}},
+		{"opened by a failed probe", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: fail, state: Open},
+			{action: allow, allowed: false, state: Open},
+		}}},
+		{"opened by a slow probe", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: slow, state: Open},
+		}}},
+		{"probes exhausted", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: false, state: HalfOpen},
+		}}},
+		{"probe released", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: release, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: false, state: HalfOpen},
+		}}},
+		{"probe recorded", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: succeed, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: false, state: HalfOpen},
+		}}},
+		{"lost probes expired", [][]step{trip, {
+			{action: wait, state: Open},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+			{action: allow, allowed: false, state: HalfOpen},
+			{action: wait, state: HalfOpen},
+			{action: allow, allowed: true, state: HalfOpen},
+		}}},
+		{"release without probe", [][]step{{
+			{action: release, state: Closed},
+			{action: allow, allowed: true, state: Closed},
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const host = "127.0.0.1:8732"
+			s := NewSet(settings, zerolog.Nop())
+			i := 0
+			for _, steps := range tt.steps {
+				for _, step := range steps {
+					i++
+					switch step.action {
+					case allow:
+						if got := s.Allow(host); got != step.allowed {
+							t.Fatalf("step %d: Allow = %v, want %v", i, got, step.allowed)
+						}
+					case succeed:
+						s.Record(host, false, time.Millisecond)
+					case fail:
+						s.Record(host, true, time.Millisecond)
+					case slow:
+						s.Record(host, false, time.Second)
+					case release:
+						s.Release(host)
+					case wait:
+						time.Sleep(openTimeout + 10*time.Millisecond)
+					}
+					if got := s.State(host); got != step.state {
+						t.Fatalf("step %d: state = %v, want %v", i, got, step.state)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetHosts(t *testing.T) {
+	s := NewSet(Settings{Window: time.Hour, MinRequests: 1, ErrorRate: 0.5, OpenTimeout: time.Hour, HalfOpenRequests: 1}, zerolog.Nop())
+	s.Record("a", true, 0)
+	if s.Allow("a") {
+		t.Error("the breaker of a is not open")
+	}
+	if !s.Allow("b") {
+		t.Error("the breaker of b is opened by a")
+	}
+}
+
+func TestConfigureKeepsStates(t *testing.T) {
+	settings := Settings{Window: time.Hour, MinRequests: 1, ErrorRate: 0.5, OpenTimeout: time.Hour, HalfOpenRequests: 1}
+	s := NewSet(settings, zerolog.Nop())
+	s.Record("a", true, 0)
+	settings.ErrorRate = 0.9
+	s.Configure(settings)
+	if got := s.State("a"); got != Open {
+		t.Errorf("state = %v after Configure, want %v", got, Open)
+	}
+}
+
+func TestNilSet(t *testing.T) {
+	var s *Set
+	s.Record("a", true, 0)
+	s.Release("a")
+	if !s.Allow("a") || s.State("a") != Closed {
+		t.Error("a nil Set must allow every request")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const usage = `Usage: tzproxy [command] [flags]
+
+Commands:
+  serve                 Start the proxy (default)
+  check-config          Validate the configuration and exit
+  print-default-config  Print the default configuration
+  explain METHOD PATH   Explain how the routes handle a request
+  version               Print the version
+
+Run 'tzproxy <command> -h' to see the flags of a command.
+`
+
+// runCommand dispatches the command line and returns the exit code.
+func runCommand(args []string) int {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if args[0] != "" {
+			command = args[0]
+		}
+		args = args[1:]
+	}
+
+	switch command {
+	case "serve":
+		options, err := parseConfigFlags(command, args)
+		if err != nil {
+			return 2
+		}
+		serve(options)
+		return 0
+	case "check-config":
+		options, err := parseConfigFlags(command, args)
+		if err != nil {
+			return 2
+		}
+		return checkConfig(options)
+	case "explain":
+		return explain(args)
+	case "print-default-config":
+		return printDefaultConfig(args)
+	case "version":
+		fmt.Println(version)
+		return 0
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		return 2
+	}
+}
+
+// overrides collects repeated -set key=value flags.
+type overrides map[string]string
+
+func (o overrides) String() string {
+	values := []string{}
+	for key, value := range o {
+		values = append(values, key+"="+value)
+	}
+	return strings.Join(values, ",")
+}
+
+func (o overrides) Set(value string) error {
+	key, val, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	o[strings.ToLower(key)] = val
+	return nil
+}
+
+func parseConfigFlags(command string, args []string) (config.Options, error) {
+	options, flags, err := parseConfigFlagSet(command, args)
+	if err != nil {
+		return options, err
+	}
+	if flags.NArg() > 0 {
+		err := fmt.Errorf("unexpected argument %q", flags.Arg(0))
+		fmt.Fprintln(os.Stderr, err)
+		return options, err
+	}
+
+	return options, nil
+}
+
+// parseConfigFlagSet parses the configuration flags and leaves the
+// positional arguments in the returned flag set.
+func parseConfigFlagSet(command string, args []string) (config.Options, *flag.FlagSet, error) {
+	options := config.Options{Overrides: overrides{}}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.StringVar(&options.File, "config", "", "path of the configuration file (default ./tzproxy.yaml)")
+	flags.Var(overrides(options.Overrides), "set", "override a setting, e.g. -set cache.ttl=10 (repeatable)")
+	err := flags.Parse(args)
+
+	return options, flags, err
+}
+
+// checkConfig validates the configuration without starting the server.
+func checkConfig(options config.Options) int {
+	file, err := config.Check(options)
+	if file == "" {
+		file = "defaults"
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "configuration %s is invalid\n", file)
+		return 1
+	}
+
+	fmt.Printf("configuration %s is valid\n", file)
+	return 0
+}
+
+// printDefaultConfig prints the default configuration, or writes it to a
+// file when -output is given.
+func printDefaultConfig(args []string) int {
+	var output string
+	flags := flag.NewFlagSet("print-default-config", flag.ContinueOnError)
+	flags.StringVar(&output, "output", "", "write the configuration to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	content, err := config.DefaultConfigYAML()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if output == "" {
+		os.Stdout.Write(content)
+		return 0
+	}
+
+	// Never overwrite an existing configuration
+	file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	if _, err := file.Write(content); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// explain prints how the route middlewares handle METHOD PATH.
+func explain(args []string) int {
+	options, flags, err := parseConfigFlagSet("explain", args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: tzproxy explain [flags] METHOD PATH")
+		return 2
+	}
+
+	explanation, err := config.Explain(options, flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Print(explanation)
+	return 0
+}
@@ -0,0 +1,129 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrLimitReached = errors.New("concurrency limit reached")
+
+// Limiter caps the number of simultaneous holders per key. Keys are created
+// on first use and dropped as soon as nobody holds or waits for them.
+type Limiter struct {
+	max   int
+	mutex sync.Mutex
+	slots map[string]*slot
+}
+
+type slot struct {
+	tokens chan struct{}
+	users  int
+}
+
+func NewLimiter(max int) *Limiter {
+	return &Limiter{
+		max:   max,
+		slots: make(map[string]*slot),
+	}
+}
+
+// Configure changes the limit, keeping the slots held. Keys in use keep
+// their former limit until nobody holds or waits for them.
+func (l *Limiter) Configure(max int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.max = max
+}
+
+// Max returns the limit.
+func (l *Limiter) Max() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.max
+}
+
+// Acquire takes a slot for key, waiting up to timeout for one to be freed.
+// A zero timeout fails immediately when the key is at its limit.
+func (l *Limiter) Acquire(ctx context.Context, key string, timeout time.Duration) error {
+	s := l.join(key)
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.tokens <- struct{}{}:
+		return nil
+	default:
+	}
+
+	if timeout <= 0 {
+		l.leave(key)
+		return ErrLimitReached
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.tokens <- struct{}{}:
+		return nil
+	case <-timer.C:
+		l.leave(key)
+		return ErrLimitReached
+	case <-ctx.Done():
+		l.leave(key)
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot previously taken with Acquire.
+func (l *Limiter) Release(key string) {
+	l.mutex.Lock()
+	s, has := l.slots[key]
+	l.mutex.Unlock()
+	if !has {
+		return
+	}
+
+	<-s.tokens
+	l.leave(key)
+}
+
+// InFlight returns the number of slots currently held for key.
+func (l *Limiter) InFlight(key string) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if s, has := l.slots[key]; has {
+		return len(s.tokens)
+	}
+	return 0
+}
+
+// join returns the slot of key, or nil when there is no limit.
+func (l *Limiter) join(key string) *slot {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s, has := l.slots[key]
+	if !has {
+		if l.max <= 0 {
+			return nil
+		}
+		s = &slot{tokens: make(chan struct{}, l.max)}
+		l.slots[key] = s
+	}
+	s.users++
+	return s
+}
+
+func (l *Limiter) leave(key string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	s, has := l.slots[key]
+	if !has {
+		return
+	}
+	s.users--
+	if s.users <= 0 {
+		delete(l.slots, key)
+	}
+}
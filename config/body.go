@@ -0,0 +1,64 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+type bodyLimit struct {
+	BodyLimit
+	routes *routes.Matcher
+}
+
+func buildBodyLimits(rules []BodyLimit) ([]*bodyLimit, error) {
+	limits := make([]*bodyLimit, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, &bodyLimit{BodyLimit: rule, routes: matcher})
+	}
+	return limits, nil
+}
+
+// BodyLimit returns the maximum body size of a request, 0 meaning no limit,
+// and whether its body must be JSON. The first matching rule is used,
+// otherwise body_limits.max_bytes applies.
+func (c *Config) BodyLimit(method, path string) (int64, bool) {
+	if !c.ConfigFile.BodyLimits.Enabled {
+		return 0, false
+	}
+
+	for _, limit := range c.BodyLimits {
+		if limit.routes.Match(method, path) {
+			maxBytes := limit.MaxBytes
+			if maxBytes == 0 {
+				maxBytes = c.ConfigFile.BodyLimits.MaxBytes
+			}
+			return maxBytes, limit.JSON
+		}
+	}
+	return c.ConfigFile.BodyLimits.MaxBytes, false
+}
+
+// describeBodyLimit summarizes the body limit for the explain command.
+func (c *Config) describeBodyLimit(method, path string) string {
+	if !c.ConfigFile.BodyLimits.Enabled {
+		return "none"
+	}
+
+	maxBytes, json := c.BodyLimit(method, path)
+	description := "no size limit"
+	if maxBytes > 0 {
+		description = fmt.Sprintf("at most %d bytes", maxBytes)
+	}
+	if json {
+		description += ", valid JSON"
+		if maxDepth := c.ConfigFile.BodyLimits.MaxJSONDepth; maxDepth > 0 {
+			description += fmt.Sprintf(" nested at most %d levels", maxDepth)
+		}
+	}
+	return description
+}
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
@@ -12,16 +16,83 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/marigold-dev/tzproxy/balancers"
+	"github.com/marigold-dev/tzproxy/bans"
+	"github.com/marigold-dev/tzproxy/breaker"
+	"github.com/marigold-dev/tzproxy/concurrency"
+	"github.com/marigold-dev/tzproxy/geoip"
+	"github.com/marigold-dev/tzproxy/iptrie"
+	"github.com/marigold-dev/tzproxy/nodes"
+	"github.com/marigold-dev/tzproxy/retry"
+	"github.com/marigold-dev/tzproxy/transports"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/diode"
 	"github.com/rs/zerolog/log"
 	"github.com/ulule/limiter/v3"
+	"github.com/ulule/limiter/v3/drivers/store/memory"
+	limiterredis "github.com/ulule/limiter/v3/drivers/store/redis"
 )
 
-func NewConfig() *Config {
-	configFile := initViper()
+func NewConfig(options Options) *Config {
+	configFile := initViper(options)
 
+	config, err := build(configFile, nil)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+
+	return config
+}
+
+// Reload reads the configuration file again and builds a new Config from
+// it. Connections, stores and the logger are carried over from c, so only
+// settings that can change at runtime are applied. c is left untouched when
+// the new file is invalid.
+func (c *Config) Reload() (*Config, error) {
+	configFile, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := build(configFile, c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range diffConfig(c.ConfigFile, next.ConfigFile) {
+		event := next.Logger.Info()
+		if change.RestartRequired {
+			event = next.Logger.Warn()
+		}
+		event.
+			Str("key", change.Key).
+			Str("old", change.Old).
+			Str("new", change.New).
+			Bool("restart_required", change.RestartRequired).
+			Msg("configuration changed")
+	}
+
+	return next, nil
+}
+
+// Release closes the long-lived resources of c that next doesn't share. It
+// is called once next replaced c, so that a failed reload leaves c working,
+// and on a Config that couldn't be built, with the one it was built from.
+func (c *Config) Release(next *Config) {
+	if c.GeoIP != nil && (next == nil || next.GeoIP != c.GeoIP) {
+		c.GeoIP.Close()
+	}
+	if c.Heads != nil && (next == nil || next.Heads != c.Heads) {
+		c.Heads.Close()
+	}
+	if c.Chains != nil && (next == nil || next.Chains != c.Chains) {
+		c.Chains.Close()
+	}
+}
+
+// build creates a Config from configFile. When previous is set, its
+// long-lived resources are reused instead of being created again.
+func build(configFile *ConfigFile, previous *Config) (*Config, error) {
 	if configFile.GC.OptimizeMemoryStore {
 		if !configFile.Redis.Enabled {
 			configFile.GC.Percent = 20
@@ -29,39 +100,127 @@ func NewConfig() *Config {
 	}
 
 	var targets = []*middleware.ProxyTarget{}
-	var retryTarget *middleware.ProxyTarget = nil
-	if configFile.TezosHostRetry != "" {
-		retryTarget = hostToTarget(configFile.TezosHostRetry)
+	var fallbacks = []balancers.Fallback{}
+	for _, fallback := range configFile.TezosHostRetry {
+		target, err := hostToTarget(fallback.Host)
+		if err != nil {
+			return nil, err
+		}
+		fallbacks = append(fallbacks, balancers.Fallback{Target: target, Weight: fallback.Weight})
 	}
 	for _, host := range configFile.TezosHost {
-		targets = append(targets, hostToTarget(host))
+		target, err := hostToTarget(host)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	denyIPsTable, err := buildIPTable(configFile.DenyIPs.Values)
+	if err != nil {
+		return nil, fmt.Errorf("deny_ips: %w", err)
+	}
+	allowIPsTable, err := buildIPTable(configFile.AllowIPs.Values)
+	if err != nil {
+		return nil, fmt.Errorf("allow_ips: %w", err)
+	}
+	ipExtractor, err := buildIPExtractor(configFile.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
 	}
 
 	var redisClient *redis.Client
-	if configFile.Redis.Enabled {
-		redisClient = redis.NewClient(&redis.Options{
-			Addr: configFile.Redis.Host,
+	var store echocache.Cache
+	var banStore bans.Store
+	var rateLimitStore limiter.Store
+	var logger zerolog.Logger
+	if previous != nil {
+		redisClient = previous.Redis
+		store = previous.Store
+		banStore = previous.Bans
+		rateLimitStore = previous.RateLimitStore
+		logger = previous.Logger
+	} else {
+		if configFile.Redis.Enabled {
+			redisClient = redis.NewClient(&redis.Options{
+				Addr: configFile.Redis.Host,
+			})
+		}
+		store = buildStore(configFile, redisClient)
+		banStore = buildBanStore(configFile, redisClient)
+		rateLimitStore = buildRateLimitStore(configFile, redisClient)
+		logger = buildLogger(configFile.DevMode)
+	}
+
+	locator, err := buildGeoIP(configFile, previous, logger)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+
+	baseTransport := buildTransport(configFile, previous)
+	heads := buildHeads(configFile, previous, targets, baseTransport, logger)
+	chains := buildChains(configFile, previous, targets, fallbacks, baseTransport, logger)
+	breakers := buildBreakers(configFile, previous, logger)
+	balancer := balancers.NewIPHashBalancer(targets, configFile.LoadBalancer.TTL, store, breakers, heads, chains)
+
+	var clientConcurrency, targetConcurrency *concurrency.Limiter
+	if configFile.Concurrency.Enabled {
+		clientConcurrency = buildLimiter(configFile.Concurrency.MaxPerClient, previous, func(c *Config) *concurrency.Limiter {
+			return c.ClientConcurrency
+		})
+		targetConcurrency = buildLimiter(configFile.Concurrency.MaxPerTarget, previous, func(c *Config) *concurrency.Limiter {
+			return c.TargetConcurrency
 		})
 	}
-	store := buildStore(configFile, redisClient)
-	balancer := balancers.NewIPHashBalancer(targets, retryTarget, configFile.LoadBalancer.TTL, store)
-	logger := buildLogger(configFile.DevMode)
+
 	proxyConfig := middleware.ProxyConfig{
 		Skipper:    middleware.DefaultSkipper,
 		ContextKey: "target",
-		RetryCount: len(configFile.TezosHost) + 1,
 		Balancer:   balancer,
-		RetryFilter: func(c echo.Context, err error) bool {
-			if httpErr, ok := err.(*echo.HTTPError); ok {
-				if httpErr.Code == http.StatusBadGateway || httpErr.Code == http.StatusNotFound || httpErr.Code == http.StatusGone {
-					return true
-				}
+		Transport:  baseTransport,
+		ErrorHandler: func(c echo.Context, err error) error {
+			if httpErr, ok := err.(*echo.HTTPError); ok && errors.Is(httpErr.Internal, concurrency.ErrLimitReached) {
+				return c.JSON(http.StatusTooManyRequests, echo.Map{
+					"success": false,
+					"message": "Too Many Concurrent Requests on " + c.Request().URL.String(),
+				})
+			}
+			if errors.Is(err, balancers.ErrNoTarget) {
+				logger.Error().
+					Str("method", c.Request().Method).
+					Str("uri", c.Request().URL.Path).
+					Str("ip", c.RealIP()).
+					Msg("no node on the expected chain")
+				return c.JSON(http.StatusServiceUnavailable, echo.Map{
+					"success": false,
+					"message": "No upstream node available",
+				})
+			}
+			if httpErr, ok := err.(*echo.HTTPError); ok && errors.Is(httpErr.Internal, transports.ErrUpstreamTimeout) {
+				logger.Warn().
+					Err(httpErr.Internal).
+					Str("method", c.Request().Method).
+					Str("uri", c.Request().URL.Path).
+					Str("ip", c.RealIP()).
+					Msg("upstream timeout")
+				return c.JSON(http.StatusGatewayTimeout, echo.Map{
+					"success": false,
+					"message": "Upstream request timed out",
+				})
+			}
+			if httpErr, ok := err.(*echo.HTTPError); ok && errors.Is(httpErr.Internal, transports.ErrResponseTooLarge) {
+				logger.Warn().
+					Str("method", c.Request().Method).
+					Str("uri", c.Request().URL.Path).
+					Str("ip", c.RealIP()).
+					Msg("upstream response too large")
+				return c.JSON(http.StatusBadGateway, echo.Map{
+					"success": false,
+					"message": "Upstream response is too large",
+				})
 			}
 
-			return false
-		},
-		ErrorHandler: func(c echo.Context, err error) error {
-        	// Log the error with additional context
+			// Log the error with additional context
 			logger.Error().
 				Err(err).
 				Str("method", c.Request().Method).
@@ -73,33 +232,56 @@ func NewConfig() *Config {
 		},
 	}
 
-	// Parse routes by http method
-	allowRegexRoutes := parseRegexRoutes(configFile.AllowRoutes.Values)
-	denyRegexRoutes := parseRegexRoutes(configFile.DenyRoutes.Values)
-	cacheDisableRegexRoutes := parseRegexRoutes(configFile.Cache.DisabledRoutes)
-
 	config := &Config{
-		ConfigFile: configFile,
-		DenyIPsTable: func() map[string]bool {
-			table := make(map[string]bool)
-			for _, ip := range configFile.DenyIPs.Values {
-				table[ip] = true
-			}
-			return table
-		}(),
+		ConfigFile:    configFile,
+		DenyIPsTable:  denyIPsTable,
+		AllowIPsTable: allowIPsTable,
 		Rate: &limiter.Rate{
 			Period: time.Duration(configFile.RateLimit.Minutes) * time.Minute,
 			Limit:  int64(configFile.RateLimit.Max),
 		},
-		Store:                    store,
-		CacheTTL:                 time.Duration(configFile.Cache.TTL) * (time.Second),
-		ProxyConfig:              &proxyConfig,
-		Redis:                    redisClient,
-		AllowRoutesRegex:         allowRegexRoutes,
-		DenyRoutesRegex:          denyRegexRoutes,
-		CacheDisabledRoutesRegex: cacheDisableRegexRoutes,
+		IPExtractor:       ipExtractor,
+		RateLimitStore:    rateLimitStore,
+		GeoIP:             locator,
+		Store:             store,
+		ClientConcurrency: clientConcurrency,
+		TargetConcurrency: targetConcurrency,
+		Bans:              banStore,
+		Breakers:          breakers,
+		RetryBudget:       buildRetryBudget(configFile, previous),
+		Fallbacks:         balancers.NewFallbackPool(fallbacks, targets, breakers, heads, chains),
+		Heads:             heads,
+		Chains:            chains,
+		Sessions:          nodes.NewSessions(store, configFile.SessionConsistency.TTLSeconds),
+		CacheTTL:          time.Duration(configFile.Cache.TTL) * (time.Second),
+		ProxyConfig:       &proxyConfig,
+		Redis:             redisClient,
+		Transport:         baseTransport,
 	}
 	config.Logger = logger
+	if err := buildRoutes(config, previous); err != nil {
+		config.Release(previous)
+		return nil, err
+	}
+	// The timeouts and response limits depend on the routes compiled above
+	proxyConfig.Transport = transports.NewTimeoutTransport(proxyConfig.Transport, func(req *http.Request) (time.Duration, time.Duration) {
+		return config.Timeout(req.Method, req.URL.Path)
+	})
+	// Outside of the timeouts, so that waiting for a slot isn't taken for a
+	// slow upstream
+	if targetConcurrency != nil {
+		queueTimeout := time.Duration(configFile.Concurrency.QueueTimeoutMs) * time.Millisecond
+		proxyConfig.Transport = transports.NewConcurrencyTransport(proxyConfig.Transport, targetConcurrency, queueTimeout)
+	}
+	proxyConfig.Transport = transports.NewRPCErrorTransport(proxyConfig.Transport)
+	if breakers != nil {
+		proxyConfig.Transport = transports.NewBreakerTransport(proxyConfig.Transport, breakers)
+	}
+	if configFile.ResponseLimits.Enabled {
+		proxyConfig.Transport = transports.NewResponseLimitTransport(proxyConfig.Transport, func(req *http.Request) int64 {
+			return config.ResponseLimit(req.Method, req.URL.Path)
+		})
+	}
 
 	config.RequestLoggerConfig = &middleware.RequestLoggerConfig{
 		LogLatency:      true,
@@ -126,8 +308,10 @@ func NewConfig() *Config {
 				return v.Error
 			}
 
+			country, _ := c.Get("country").(string)
 			config.Logger.Info().
 				Str("ip", v.RemoteIP).
+				Str("country", country).
 				Str("protocol", v.Protocol).
 				Int("status", v.Status).
 				Str("method", v.Method).
@@ -142,7 +326,7 @@ func NewConfig() *Config {
 		},
 	}
 
-	return config
+	return config, nil
 }
 
 func buildStore(cf *ConfigFile, redis *redis.Client) echocache.Cache {
@@ -156,6 +340,62 @@ func buildStore(cf *ConfigFile, redis *redis.Client) echocache.Cache {
 	return &memoryStore
 }
 
+func buildRateLimitStore(cf *ConfigFile, redisClient *redis.Client) limiter.Store {
+	if cf.Redis.Enabled {
+		store, err := limiterredis.NewStore(redisClient)
+		if err != nil {
+			log.Fatal().Err(err).Msg("unable to create rate limit store")
+		}
+		return store
+	}
+
+	return memory.NewStore()
+}
+
+func buildBanStore(cf *ConfigFile, redis *redis.Client) bans.Store {
+	if cf.Redis.Enabled {
+		return bans.NewRedisStore(redis)
+	}
+
+	return bans.NewMemoryStore()
+}
+
+// buildBreakers returns nil when circuit breaking is disabled. The states are
+// kept across reloads.
+func buildBreakers(cf *ConfigFile, previous *Config, logger zerolog.Logger) *breaker.Set {
+	if !cf.CircuitBreaker.Enabled {
+		return nil
+	}
+
+	settings := breaker.Settings{
+		Window:           time.Duration(cf.CircuitBreaker.WindowSeconds) * time.Second,
+		MinRequests:      cf.CircuitBreaker.MinRequests,
+		ErrorRate:        float64(cf.CircuitBreaker.ErrorRate) / 100,
+		SlowThreshold:    time.Duration(cf.CircuitBreaker.SlowMs) * time.Millisecond,
+		SlowRate:         float64(cf.CircuitBreaker.SlowRate) / 100,
+		OpenTimeout:      time.Duration(cf.CircuitBreaker.OpenSeconds) * time.Second,
+		HalfOpenRequests: cf.CircuitBreaker.HalfOpenRequests,
+	}
+	if previous != nil && previous.Breakers != nil {
+		previous.Breakers.Configure(settings)
+		return previous.Breakers
+	}
+	return breaker.NewSet(settings, logger)
+}
+
+// buildLimiter reuses the limiter of the previous configuration, so that
+// the slots held are kept across reloads. Without a previous limit, a new
+// limiter is created, as requests may be in flight without a slot.
+func buildLimiter(max int, previous *Config, limiter func(*Config) *concurrency.Limiter) *concurrency.Limiter {
+	if previous != nil {
+		if current := limiter(previous); current != nil && current.Max() > 0 && max > 0 {
+			current.Configure(max)
+			return current
+		}
+	}
+	return concurrency.NewLimiter(max)
+}
+
 func buildLogger(devMode bool) zerolog.Logger {
 	if !devMode {
 		bunchWriter := diode.NewWriter(
@@ -171,15 +411,177 @@ func buildLogger(devMode bool) zerolog.Logger {
 	return log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
-func hostToTarget(host string) *middleware.ProxyTarget {
+// buildGeoIP reuses the previous locator unless its databases changed,
+// the locator already reloads itself when the files are updated. A locator
+// replaced is closed by Release.
+func buildGeoIP(cf *ConfigFile, previous *Config, logger zerolog.Logger) (*geoip.Locator, error) {
+	var current *geoip.Locator
+	if previous != nil {
+		current = previous.GeoIP
+	}
+
+	if current != nil && cf.GeoIP.Enabled &&
+		previous.ConfigFile.GeoIP.Database == cf.GeoIP.Database &&
+		previous.ConfigFile.GeoIP.ASNDatabase == cf.GeoIP.ASNDatabase {
+		return current, nil
+	}
+
+	var locator *geoip.Locator
+	if cf.GeoIP.Enabled {
+		var err error
+		locator, err = geoip.Open(cf.GeoIP.Database, cf.GeoIP.ASNDatabase, logger)
+		if err != nil {
+			return nil, err
+		}
+		if err := locator.Watch(); err != nil {
+			return nil, err
+		}
+	}
+	return locator, nil
+}
+
+// buildHeads polls the heads of the targets for the session consistency and
+// the block pinning. The previous tracker is reused unless the targets or
+// the interval changed.
+func buildHeads(cf *ConfigFile, previous *Config, targets []*middleware.ProxyTarget, transport http.RoundTripper, logger zerolog.Logger) *nodes.HeadTracker {
+	var current *nodes.HeadTracker
+	if previous != nil {
+		current = previous.Heads
+	}
+
+	enabled := cf.SessionConsistency.Enabled || cf.BlockPinning.Enabled
+	if current != nil && enabled &&
+		reflect.DeepEqual(previous.ConfigFile.TezosHost, cf.TezosHost) &&
+		previous.ConfigFile.SessionConsistency.PollIntervalMs == cf.SessionConsistency.PollIntervalMs {
+		return current
+	}
+
+	var heads *nodes.HeadTracker
+	if enabled {
+		urls := make([]*url.URL, len(targets))
+		for i, target := range targets {
+			urls[i] = target.URL
+		}
+		interval := time.Duration(cf.SessionConsistency.PollIntervalMs) * time.Millisecond
+		heads = nodes.NewHeadTracker(urls, transport, interval, logger)
+		heads.Start()
+	}
+	return heads
+}
+
+// buildChains checks the chain of the targets and of the fallbacks, the
+// latter against retry_expected_chain_id when it is set. The previous
+// checker is reused unless the nodes or the settings changed.
+func buildChains(cf *ConfigFile, previous *Config, targets []*middleware.ProxyTarget, fallbacks []balancers.Fallback, transport http.RoundTripper, logger zerolog.Logger) *nodes.ChainChecker {
+	var current *nodes.ChainChecker
+	if previous != nil {
+		current = previous.Chains
+	}
+
+	if current != nil && cf.ChainVerification.Enabled &&
+		reflect.DeepEqual(previous.ConfigFile.TezosHost, cf.TezosHost) &&
+		reflect.DeepEqual(previous.ConfigFile.TezosHostRetry, cf.TezosHostRetry) &&
+		previous.ConfigFile.ChainVerification == cf.ChainVerification {
+		return current
+	}
+
+	var chains *nodes.ChainChecker
+	if cf.ChainVerification.Enabled {
+		retryChainID := cf.ChainVerification.RetryExpectedChainID
+		if retryChainID == "" {
+			retryChainID = cf.ChainVerification.ExpectedChainID
+		}
+		chainTargets := []nodes.ChainTarget{}
+		for _, target := range targets {
+			chainTargets = append(chainTargets, nodes.ChainTarget{URL: target.URL, ChainID: cf.ChainVerification.ExpectedChainID})
+		}
+		for _, fallback := range fallbacks {
+			chainTargets = append(chainTargets, nodes.ChainTarget{URL: fallback.Target.URL, ChainID: retryChainID})
+		}
+		interval := time.Duration(cf.ChainVerification.IntervalSeconds) * time.Second
+		chains = nodes.NewChainChecker(chainTargets, transport, interval, logger)
+		chains.Start()
+	}
+	return chains
+}
+
+func buildIPTable(values []string) (*iptrie.Trie, error) {
+	table := iptrie.New()
+	for _, value := range values {
+		ipNet, err := parseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		table.Insert(ipNet)
+	}
+	return table, nil
+}
+
+// buildIPExtractor only honors X-Forwarded-For when the request comes from
+// one of the trusted proxies, otherwise the client IP is the peer address.
+func buildIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		ipNet, err := parseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// parseCIDR accepts both CIDR ranges and single IP addresses.
+func parseCIDR(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: value}
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(value)
+	return ipNet, err
+}
+
+func hostToTarget(host string) (*middleware.ProxyTarget, error) {
 	hostWithScheme := host
 	if !strings.Contains(host, "http") {
 		hostWithScheme = "http://" + host
 	}
 	targetURL, err := url.ParseRequestURI(hostWithScheme)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to parse host")
+		return nil, fmt.Errorf("unable to parse host %q: %w", host, err)
 	}
 
-	return &middleware.ProxyTarget{URL: targetURL}
+	return &middleware.ProxyTarget{URL: targetURL}, nil
+}
+
+// buildRetryBudget counts the retries against the requests over windows of
+// ten seconds. The budget of the previous configuration is kept, so that a
+// reload doesn't reset the counts.
+func buildRetryBudget(cf *ConfigFile, previous *Config) *retry.Budget {
+	if !cf.Retry.Enabled {
+		return nil
+	}
+	if previous != nil && previous.RetryBudget != nil {
+		previous.RetryBudget.Configure(cf.Retry.BudgetPercent, cf.Retry.BudgetMinRetries)
+		return previous.RetryBudget
+	}
+	return retry.NewBudget(cf.Retry.BudgetPercent, cf.Retry.BudgetMinRetries, 10*time.Second)
 }
@@ -4,7 +4,11 @@ var defaultConfig = &ConfigFile{
 	DevMode:        false,
 	Host:           "0.0.0.0:8080",
 	TezosHost:      []string{"127.0.0.1:8732"},
-	TezosHostRetry: "",
+	TezosHostRetry: []Fallback{},
+	TrustedProxies: []string{},
+	ProxyProtocol: ProxyProtocol{
+		Enabled: false,
+	},
 	Redis: Redis{
 		Host:    "",
 		Enabled: false,
@@ -17,17 +21,25 @@ var defaultConfig = &ConfigFile{
 		PoolIntervalSeconds: 1,
 	},
 	RateLimit: RateLimit{
-		Enabled: false,
-		Minutes: 1,
-		Max:     300,
+		Enabled:  false,
+		Minutes:  1,
+		Max:      300,
+		FailOpen: true,
+	},
+	Concurrency: ConcurrencyLimit{
+		Enabled:        false,
+		KeyHeader:      "",
+		MaxPerClient:   20,
+		MaxPerTarget:   500,
+		QueueTimeoutMs: 0,
 	},
 	Cache: Cache{
 		Enabled: true,
 		TTL:     5,
 		DisabledRoutes: []string{
-			"GET/monitor/.*",
-			"GET/chains/.*/mempool",
-			"GET/chains/.*/blocks.*head",
+			"GET /monitor/**",
+			"GET /chains/{chain}/mempool/**",
+			"GET /chains/{chain}/blocks/{block:head}/**",
 		},
 		SizeMB: 100,
 	},
@@ -35,50 +47,222 @@ var defaultConfig = &ConfigFile{
 		Enabled: false,
 		Values:  []string{},
 	},
+	AllowIPs: AllowIPs{
+		Enabled:         false,
+		Values:          []string{},
+		BypassRateLimit: false,
+	},
+	GeoIP: GeoIP{
+		Enabled:            false,
+		Database:           "",
+		ASNDatabase:        "",
+		AllowCountries:     []string{},
+		DenyCountries:      []string{},
+		AllowASNs:          []uint{},
+		DenyASNs:           []uint{},
+		RateLimitCountries: []string{},
+		RateLimitMax:       60,
+	},
+	AutoBan: AutoBan{
+		Enabled:          false,
+		WindowSeconds:    60,
+		BanSeconds:       600,
+		MaxForbidden:     50,
+		MaxRateLimited:   100,
+		MaxBadInjections: 20,
+	},
 	AllowRoutes: AllowRoutes{
 		Enabled: true,
 		Values: []string{
-			"GET/chains/.*/blocks",
-			"GET/chains/.*/chain_id", "GET/chains.*/checkpoint",
-			"GET/chains/.*/invalid_blocks", "GET/chains.*/invalid_blocks.*",
-			"GET/chains/.*/is_bootstrapped", "GET/chains.*/mempool/filter",
-			"GET/chains/.*/mempool/monitor_operations",
-			"GET/chains/.*/mempool/pending_operations",
-			"GET/config/network/user_activated_protocol_overrides",
-			"GET/config/network/user_activated_upgrades",
-			"GET/config/network/dal",
-			"GET/network/stat", "GET/network/version", "GET/network/versions",
-			"GET/protocols", "GET/protocols.*", "GET/protocols.*/environment",
-			"GET/monitor.*",
-			"GET/version",
-			"POST/chains/.*/blocks/.*/helpers",
-			"POST/chains/.*/blocks/.*/script",
-			"POST/chains/.*/blocks/.*/context/contracts.*/big_map_get",
-			"POST/chains/.*/blocks/.*/context/contracts.*/ticket_balance",
-			"POST/injection/operation",
+			"GET /chains/{chain}/blocks/**",
+			"GET /chains/{chain}/chain_id",
+			"GET /chains/{chain}/checkpoint",
+			"GET /chains/{chain}/invalid_blocks/**",
+			"GET /chains/{chain}/is_bootstrapped",
+			"GET /chains/{chain}/mempool/filter",
+			"GET /chains/{chain}/mempool/monitor_operations",
+			"GET /chains/{chain}/mempool/pending_operations",
+			"GET /config/network/user_activated_protocol_overrides",
+			"GET /config/network/user_activated_upgrades",
+			"GET /config/network/dal",
+			"GET /network/stat", "GET /network/version", "GET /network/versions",
+			"GET /protocols/**",
+			"GET /monitor/**",
+			"GET /version",
+			"POST /chains/{chain}/blocks/{block}/helpers/**",
+			"POST /chains/{chain}/blocks/{block}/context/contracts/{contract}/script/**",
+			"POST /chains/{chain}/blocks/{block}/context/contracts/{contract}/big_map_get",
+			"POST /chains/{chain}/blocks/{block}/context/contracts/{contract}/ticket_balance",
+			"POST /injection/operation",
 		},
 	},
 	DenyRoutes: DenyRoutes{
 		Enabled: true,
 		Values: []string{
-			"GET/workers.*",
-			"GET/worker.*",
-			"GET/stats.*",
-			"GET/chains/.*/blocks/.*/helpers/baking_rights",
-			"GET/chains/.*/blocks/.*/helpers/endorsing_rights",
-			"GET/helpers/baking_rights",
-			"GET/helpers/endorsing_rights",
-			"GET/chains/.*/blocks/.*/context/contracts(/?)$",
-			"GET/chains/.*/blocks/.*/context/raw/bytes",
-			"POST/injection/block",
-			"POST/injection/protocol",
+			"GET /workers/**",
+			"GET /worker/**",
+			"GET /stats/**",
+			"GET /chains/{any}/blocks/{any}/helpers/baking_rights",
+			"GET /chains/{any}/blocks/{any}/helpers/endorsing_rights",
+			"GET /helpers/baking_rights",
+			"GET /helpers/endorsing_rights",
+			"GET /chains/{any}/blocks/{any}/context/contracts",
+			"GET /chains/{any}/blocks/{any}/context/raw/bytes/**",
+			"POST /injection/block",
+			"POST /injection/protocol",
 		},
 	},
+	QueryPolicies: QueryPolicies{
+		Enabled: false,
+		Rules: []QueryPolicy{
+			{
+				Routes: []string{"GET /chains/{chain}/blocks/{block}/context/raw/json/**"},
+				Cap:    map[string]int{"depth": 3},
+			},
+			{
+				Routes: []string{"GET /chains/{chain}/blocks/{block}/**"},
+				Deny:   []string{"force_metadata"},
+			},
+			{
+				Routes: []string{"GET /chains/{chain}/blocks"},
+				Cap:    map[string]int{"length": 100},
+			},
+		},
+	},
+	BodyLimits: BodyLimits{
+		Enabled:      true,
+		MaxBytes:     10 << 20,
+		MaxJSONDepth: 512,
+		Rules: []BodyLimit{
+			{
+				Routes:   []string{"POST /injection/operation"},
+				MaxBytes: 1 << 20,
+				JSON:     true,
+			},
+			{
+				Routes: []string{
+					"POST /chains/{chain}/blocks/{block}/helpers/**",
+					"POST /chains/{chain}/blocks/{block}/context/contracts/{contract}/**",
+				},
+				MaxBytes: 5 << 20,
+				JSON:     true,
+			},
+		},
+	},
+	ResponseLimits: ResponseLimits{
+		Enabled:        true,
+		MaxBytes:       0,
+		BufferMaxBytes: 4 << 20,
+		Rules: []ResponseLimit{
+			{
+				Routes:   []string{"GET /chains/{chain}/blocks/{block}/context/raw/json/**"},
+				MaxBytes: 50 << 20,
+			},
+		},
+	},
+	Timeouts: Timeouts{
+		DialMs:           5000,
+		TLSHandshakeMs:   5000,
+		ResponseHeaderMs: 30000,
+		TotalMs:          120000,
+		Rules: []Timeout{
+			{
+				Routes: []string{
+					"GET /chains/{chain}/blocks/{block}/hash",
+					"GET /chains/{chain}/blocks/{block}/header",
+					"GET /version",
+				},
+				ResponseHeaderMs: 5000,
+			},
+			{
+				Routes:           []string{"POST /chains/{chain}/blocks/{block}/helpers/scripts/**"},
+				ResponseHeaderMs: 60000,
+			},
+		},
+	},
+	Retry: Retry{
+		Enabled:          true,
+		MaxAttempts:      2,
+		BackoffMs:        50,
+		MaxBackoffMs:     1000,
+		Jitter:           true,
+		BudgetPercent:    20,
+		BudgetMinRetries: 10,
+		BufferMaxBytes:   64 << 10,
+		Rules: []RetryRule{
+			{
+				Routes:   []string{"GET /**"},
+				Statuses: []int{502},
+			},
+			{
+				Routes:       []string{"GET /**"},
+				Statuses:     []int{403, 404, 410},
+				FallbackOnly: true,
+			},
+			{
+				Routes:     []string{"GET /**"},
+				Statuses:   []int{500},
+				ErrorKinds: []string{"temporary"},
+			},
+			{
+				Routes:       []string{"POST /chains/main/blocks/head/helpers/scripts/**"},
+				Statuses:     []int{502},
+				FallbackOnly: true,
+			},
+		},
+	},
+	Hedging: Hedging{
+		Enabled:    false,
+		MinDelayMs: 10,
+		Rules: []HedgeRule{
+			{
+				Routes:     []string{"GET /chains/{chain}/blocks/{block}/header"},
+				Percentile: 95,
+				DelayMs:    50,
+			},
+			{
+				Routes:     []string{"GET /chains/{chain}/blocks/{block}/context/contracts/{contract}/balance"},
+				Percentile: 95,
+				DelayMs:    100,
+			},
+		},
+	},
+	SessionConsistency: SessionConsistency{
+		Enabled:        false,
+		KeyHeader:      "",
+		TTLSeconds:     300,
+		PollIntervalMs: 2000,
+		RewriteHead:    false,
+	},
+	BlockPinning: BlockPinning{
+		Enabled: false,
+		Header:  "X-Tezos-Pin-Block",
+	},
+	ChainVerification: ChainVerification{
+		Enabled:              false,
+		ExpectedChainID:      "",
+		RetryExpectedChainID: "",
+		IntervalSeconds:      60,
+	},
+	CircuitBreaker: CircuitBreaker{
+		Enabled:          false,
+		WindowSeconds:    30,
+		MinRequests:      20,
+		ErrorRate:        50,
+		SlowMs:           10000,
+		SlowRate:         0,
+		OpenSeconds:      30,
+		HalfOpenRequests: 3,
+	},
 	Metrics: Metrics{
 		Host:    "0.0.0.0:9000",
 		Enabled: true,
 		Pprof:   false,
 	},
+	Admin: Admin{
+		Host:    "127.0.0.1:9001",
+		Enabled: false,
+	},
 	GC: GC{
 		OptimizeMemoryStore: true,
 		Percent:             100,
@@ -86,6 +270,9 @@ var defaultConfig = &ConfigFile{
 	GZIP: GZIP{
 		Enabled: true,
 	},
+	NormalizePath: NormalizePath{
+		Enabled: true,
+	},
 	CORS: CORS{
 		Enabled: true,
 	},
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type Change struct {
+	Key             string
+	Old             string
+	New             string
+	RestartRequired bool
+}
+
+// Settings that are only read at startup.
+var restartRequiredKeys = []string{
+	"dev_mode", "host", "proxy_protocol.", "redis.", "logger.", "metrics.",
+	"admin.", "gc.", "cache.size_mb", "timeouts.dial_ms", "timeouts.tls_handshake_ms",
+}
+
+// diffConfig lists the settings that differ between two configurations,
+// using the same keys as the configuration file.
+func diffConfig(old, new *ConfigFile) []Change {
+	changes := []Change{}
+	diffValue("", reflect.ValueOf(*old), reflect.ValueOf(*new), &changes)
+	return changes
+}
+
+func diffValue(key string, old, new reflect.Value, changes *[]Change) {
+	if old.Kind() == reflect.Struct {
+		for i := 0; i < old.NumField(); i++ {
+			field := old.Type().Field(i)
+			name := field.Tag.Get("mapstructure")
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if key != "" {
+				name = key + "." + name
+			}
+			diffValue(name, old.Field(i), new.Field(i), changes)
+		}
+		return
+	}
+
+	if reflect.DeepEqual(old.Interface(), new.Interface()) {
+		return
+	}
+
+	*changes = append(*changes, Change{
+		Key:             key,
+		Old:             fmt.Sprintf("%v", old.Interface()),
+		New:             fmt.Sprintf("%v", new.Interface()),
+		RestartRequired: restartRequired(key),
+	})
+}
+
+func restartRequired(key string) bool {
+	for _, prefix := range restartRequiredKeys {
+		if key == prefix || (strings.HasSuffix(prefix, ".") && strings.HasPrefix(key, prefix)) {
+			return true
+		}
+	}
+	return false
+}
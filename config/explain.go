@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ulule/limiter/v3"
+)
+
+// Explanation describes how the route middlewares handle a request.
+type Explanation struct {
+	Method               string
+	Path                 string
+	Allowed              bool
+	AllowMatches         []string
+	DenyMatches          []string
+	Cached               bool
+	CacheTTL             time.Duration
+	CacheDisabledMatches []string
+	QueryPolicies        []string
+	Body                 string
+	Retry                string
+	Hedge                string
+	RateLimit            string
+}
+
+// Explain loads the configuration like NewConfig does, without opening any
+// store or connection, and explains how a request would be handled.
+func Explain(options Options, method, path string) (*Explanation, error) {
+	if err := setupViper(options); err != nil {
+		return nil, err
+	}
+	configFile, err := readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		ConfigFile: configFile,
+		Rate: &limiter.Rate{
+			Period: time.Duration(configFile.RateLimit.Minutes) * time.Minute,
+			Limit:  int64(configFile.RateLimit.Max),
+		},
+		CacheTTL: time.Duration(configFile.Cache.TTL) * (time.Second),
+	}
+	if err := buildRoutes(config, nil); err != nil {
+		return nil, err
+	}
+
+	return config.Explain(method, path), nil
+}
+
+// Explain tells how the route middlewares handle a request, listing every
+// pattern that matches it.
+func (c *Config) Explain(method, path string) *Explanation {
+	method = strings.ToUpper(method)
+	e := &Explanation{Method: method, Path: path}
+	// Matches are left nil when the feature is disabled
+	if c.ConfigFile.AllowRoutes.Enabled {
+		e.AllowMatches = c.AllowRoutes.Matches(method, path)
+	}
+	if c.ConfigFile.DenyRoutes.Enabled {
+		e.DenyMatches = c.DenyRoutes.Matches(method, path)
+	}
+	if c.ConfigFile.Cache.Enabled {
+		e.CacheDisabledMatches = c.CacheDisabledRoutes.Matches(method, path)
+	}
+	e.Allowed = c.IsRouteAllowed(method, path) && !c.IsRouteDenied(method, path)
+	e.Cached = e.Allowed && c.IsCacheable(method, path)
+	if e.Cached {
+		e.CacheTTL = c.CacheTTL
+	}
+	if c.ConfigFile.QueryPolicies.Enabled {
+		e.QueryPolicies = []string{}
+		for _, policy := range c.QueryPolicies {
+			if policy.routes.Match(method, path) {
+				e.QueryPolicies = append(e.QueryPolicies, policy.describe())
+			}
+		}
+	}
+	e.Body = c.describeBodyLimit(method, path)
+	e.Retry = c.describeRetry(method, path)
+	e.Hedge = c.describeHedge(method, path)
+	e.RateLimit = c.rateLimitPolicy()
+
+	return e
+}
+
+func (c *Config) rateLimitPolicy() string {
+	if !c.ConfigFile.RateLimit.Enabled {
+		return "none"
+	}
+
+	policy := fmt.Sprintf("%d requests per %s per client", c.Rate.Limit, c.Rate.Period)
+	if c.ConfigFile.RateLimit.FailOpen {
+		policy += ", fail open"
+	} else {
+		policy += ", fail closed"
+	}
+	if c.ConfigFile.AllowIPs.Enabled && c.ConfigFile.AllowIPs.BypassRateLimit {
+		policy += ", bypassed by allow_ips"
+	}
+	if c.ConfigFile.GeoIP.Enabled && len(c.ConfigFile.GeoIP.RateLimitCountries) > 0 {
+		policy += fmt.Sprintf("; %d requests per %s per client from %s",
+			c.ConfigFile.GeoIP.RateLimitMax, c.Rate.Period,
+			strings.Join(c.ConfigFile.GeoIP.RateLimitCountries, ", "))
+	}
+
+	return policy
+}
+
+// String renders the explanation as a human readable report.
+func (e *Explanation) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s\n", e.Method, e.Path)
+	if e.Allowed {
+		fmt.Fprintln(&b, "  access:     allowed")
+	} else {
+		fmt.Fprintln(&b, "  access:     denied (403)")
+	}
+	fmt.Fprintf(&b, "  allow:      %s\n", describeMatches(e.AllowMatches))
+	fmt.Fprintf(&b, "  deny:       %s\n", describeMatches(e.DenyMatches))
+	if e.Cached {
+		fmt.Fprintf(&b, "  cache:      cached for %s\n", e.CacheTTL)
+	} else {
+		fmt.Fprintln(&b, "  cache:      not cached")
+	}
+	fmt.Fprintf(&b, "  no cache:   %s\n", describeMatches(e.CacheDisabledMatches))
+	fmt.Fprintf(&b, "  query:      %s\n", describeMatches(e.QueryPolicies))
+	fmt.Fprintf(&b, "  body:       %s\n", e.Body)
+	fmt.Fprintf(&b, "  retry:      %s\n", e.Retry)
+	fmt.Fprintf(&b, "  hedge:      %s\n", e.Hedge)
+	fmt.Fprintf(&b, "  rate limit: %s\n", e.RateLimit)
+
+	return b.String()
+}
+
+func describeMatches(matches []string) string {
+	if matches == nil {
+		return "disabled"
+	}
+	if len(matches) == 0 {
+		return "no pattern matched"
+	}
+	return strings.Join(matches, ", ")
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/latency"
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+const (
+	// hedgeSamples is the number of latencies kept for each hedging rule.
+	hedgeSamples = 1000
+	// hedgeMinSamples is the number of latencies needed before the
+	// percentile replaces the delay of a rule.
+	hedgeMinSamples = 100
+)
+
+type hedgeRule struct {
+	HedgeRule
+	routes    *routes.Matcher
+	latencies *latency.Tracker
+}
+
+// buildHedgeRules compiles the hedging rules. The latencies learned by a
+// previous rule with the same routes and percentile are kept, so that a
+// reload doesn't bring the delays back to delay_ms.
+func buildHedgeRules(rules []HedgeRule, previous []*hedgeRule) ([]*hedgeRule, error) {
+	hedges := make([]*hedgeRule, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		latencies := latency.NewTracker(hedgeSamples, float64(rule.Percentile))
+		for _, old := range previous {
+			if slices.Equal(old.Routes, rule.Routes) && old.Percentile == rule.Percentile {
+				latencies = old.latencies
+				break
+			}
+		}
+		hedges = append(hedges, &hedgeRule{
+			HedgeRule: rule,
+			routes:    matcher,
+			latencies: latencies,
+		})
+	}
+	return hedges, nil
+}
+
+func (c *Config) hedgeRule(method, path string) *hedgeRule {
+	if !c.ConfigFile.Hedging.Enabled {
+		return nil
+	}
+	for _, rule := range c.HedgeRules {
+		if rule.routes.Match(method, path) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// HedgeDelay returns how long to wait for a target before sending the
+// request to another one, and false when the request isn't hedged. It is
+// the percentile of the recent latencies of the first matching rule, or
+// the delay of the rule until enough of them are known.
+func (c *Config) HedgeDelay(method, path string) (time.Duration, bool) {
+	rule := c.hedgeRule(method, path)
+	if rule == nil {
+		return 0, false
+	}
+
+	delay, ok := rule.latencies.Percentile(hedgeMinSamples)
+	if !ok {
+		delay = time.Duration(rule.DelayMs) * time.Millisecond
+	}
+	return max(delay, time.Duration(c.ConfigFile.Hedging.MinDelayMs)*time.Millisecond), true
+}
+
+// ObserveLatency records the latency of the first target of a hedged
+// request.
+func (c *Config) ObserveLatency(method, path string, latency time.Duration) {
+	if rule := c.hedgeRule(method, path); rule != nil {
+		rule.latencies.Observe(latency)
+	}
+}
+
+func (c *Config) describeHedge(method, path string) string {
+	rule := c.hedgeRule(method, path)
+	if rule == nil || method != http.MethodGet {
+		return "none"
+	}
+	return fmt.Sprintf("after the p%d latency, %s until %d responses are known",
+		rule.Percentile, time.Duration(max(rule.DelayMs, c.ConfigFile.Hedging.MinDelayMs))*time.Millisecond, hedgeMinSamples)
+}
@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestBuildHedgeRulesKeepsLatencies(t *testing.T) {
+	rules := []HedgeRule{
+		{Routes: []string{"GET /chains/{chain}/blocks/{block}/header"}, Percentile: 95, DelayMs: 100},
+		{Routes: []string{"GET /chains/{chain}/blocks/{block}/context/**"}, Percentile: 95, DelayMs: 100},
+	}
+	previous, err := buildHedgeRules(rules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := []HedgeRule{
+		// Only the delay changed
+		{Routes: rules[0].Routes, Percentile: 95, DelayMs: 200},
+		{Routes: rules[1].Routes, Percentile: 99, DelayMs: 100},
+		{Routes: []string{"GET /chains/{chain}/blocks/{block}/operations/**"}, Percentile: 95, DelayMs: 100},
+	}
+	next, err := buildHedgeRules(changed, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next[0].latencies != previous[0].latencies {
+		t.Error("the latencies of an unchanged rule are not kept")
+	}
+	if next[1].latencies == previous[1].latencies {
+		t.Error("the latencies are kept for another percentile")
+	}
+	if next[2].latencies == previous[0].latencies || next[2].latencies == previous[1].latencies {
+		t.Error("the latencies are kept for other routes")
+	}
+}
@@ -1,31 +1,61 @@
 package config
 
 import (
-	"regexp"
+	"net/http"
 	"time"
 
 	echocache "github.com/fraidev/go-echo-cache"
+	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/marigold-dev/tzproxy/balancers"
+	"github.com/marigold-dev/tzproxy/bans"
+	"github.com/marigold-dev/tzproxy/breaker"
+	"github.com/marigold-dev/tzproxy/concurrency"
+	"github.com/marigold-dev/tzproxy/geoip"
+	"github.com/marigold-dev/tzproxy/iptrie"
+	"github.com/marigold-dev/tzproxy/nodes"
+	"github.com/marigold-dev/tzproxy/retry"
+	"github.com/marigold-dev/tzproxy/routes"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 	"github.com/ulule/limiter/v3"
 )
 
 type Config struct {
-	Level                    uint
-	HashBlock                string
-	ConfigFile               *ConfigFile
-	Rate                     *limiter.Rate
-	DenyIPsTable             map[string]bool
-	CacheDisabledRoutesRegex map[string][]*regexp.Regexp
-	DenyRoutesRegex          map[string][]*regexp.Regexp
-	AllowRoutesRegex         map[string][]*regexp.Regexp
-	Store                    echocache.Cache
-	CacheTTL                 time.Duration
-	RequestLoggerConfig      *middleware.RequestLoggerConfig
-	ProxyConfig              *middleware.ProxyConfig
-	Redis                    *redis.Client
-	Logger                   zerolog.Logger
+	Level               uint
+	IPExtractor         echo.IPExtractor
+	HashBlock           string
+	ConfigFile          *ConfigFile
+	Rate                *limiter.Rate
+	RateLimitStore      limiter.Store
+	GeoIP               *geoip.Locator
+	DenyIPsTable        *iptrie.Trie
+	AllowIPsTable       *iptrie.Trie
+	CacheDisabledRoutes *routes.Matcher
+	DenyRoutes          *routes.Matcher
+	AllowRoutes         *routes.Matcher
+	QueryPolicies       []*queryPolicy
+	BodyLimits          []*bodyLimit
+	ResponseLimits      []*responseLimit
+	Timeouts            []*timeoutRule
+	RetryRules          []*retryRule
+	RetryBudget         *retry.Budget
+	Fallbacks           *balancers.FallbackPool
+	HedgeRules          []*hedgeRule
+	Heads               *nodes.HeadTracker
+	Chains              *nodes.ChainChecker
+	Sessions            *nodes.Sessions
+	Transport           *http.Transport
+	Store               echocache.Cache
+	ClientConcurrency   *concurrency.Limiter
+	TargetConcurrency   *concurrency.Limiter
+	Bans                bans.Store
+	Breakers            *breaker.Set
+	CacheTTL            time.Duration
+	RequestLoggerConfig *middleware.RequestLoggerConfig
+	ProxyConfig         *middleware.ProxyConfig
+	Redis               *redis.Client
+	Logger              zerolog.Logger
 }
 
 type Logger struct {
@@ -34,9 +64,44 @@ type Logger struct {
 }
 
 type RateLimit struct {
-	Enabled bool    `mapstructure:"enabled"`
-	Minutes float64 `mapstructure:"minutes"`
-	Max     int     `mapstructure:"max"`
+	Enabled  bool    `mapstructure:"enabled"`
+	Minutes  float64 `mapstructure:"minutes"`
+	Max      int     `mapstructure:"max"`
+	FailOpen bool    `mapstructure:"fail_open"`
+}
+
+type ConcurrencyLimit struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	KeyHeader      string `mapstructure:"key_header"`
+	MaxPerClient   int    `mapstructure:"max_per_client"`
+	MaxPerTarget   int    `mapstructure:"max_per_target"`
+	QueueTimeoutMs int    `mapstructure:"queue_timeout_ms"`
+}
+
+type AutoBan struct {
+	Enabled          bool `mapstructure:"enabled"`
+	WindowSeconds    int  `mapstructure:"window_seconds"`
+	BanSeconds       int  `mapstructure:"ban_seconds"`
+	MaxForbidden     int  `mapstructure:"max_forbidden"`
+	MaxRateLimited   int  `mapstructure:"max_rate_limited"`
+	MaxBadInjections int  `mapstructure:"max_bad_injections"`
+}
+
+type Admin struct {
+	Host    string `mapstructure:"host"`
+	Enabled bool   `mapstructure:"enabled"`
+}
+
+type GeoIP struct {
+	Enabled            bool     `mapstructure:"enabled"`
+	Database           string   `mapstructure:"database"`
+	ASNDatabase        string   `mapstructure:"asn_database"`
+	AllowCountries     []string `mapstructure:"allow_countries"`
+	DenyCountries      []string `mapstructure:"deny_countries"`
+	AllowASNs          []uint   `mapstructure:"allow_asns"`
+	DenyASNs           []uint   `mapstructure:"deny_asns"`
+	RateLimitCountries []string `mapstructure:"rate_limit_countries"`
+	RateLimitMax       int      `mapstructure:"rate_limit_max"`
 }
 
 type Cache struct {
@@ -51,6 +116,12 @@ type DenyIPs struct {
 	Values  []string `mapstructure:"values"`
 }
 
+type AllowIPs struct {
+	Enabled         bool     `mapstructure:"enabled"`
+	Values          []string `mapstructure:"values"`
+	BypassRateLimit bool     `mapstructure:"bypass_rate_limit"`
+}
+
 type AllowRoutes struct {
 	Enabled bool     `mapstructure:"enabled"`
 	Values  []string `mapstructure:"values"`
@@ -61,6 +132,129 @@ type DenyRoutes struct {
 	Values  []string `mapstructure:"values"`
 }
 
+type QueryPolicies struct {
+	Enabled bool          `mapstructure:"enabled"`
+	Rules   []QueryPolicy `mapstructure:"rules"`
+}
+
+type QueryPolicy struct {
+	Routes []string       `mapstructure:"routes" yaml:"routes,omitempty"`
+	Allow  []string       `mapstructure:"allow" yaml:"allow,omitempty"`
+	Deny   []string       `mapstructure:"deny" yaml:"deny,omitempty"`
+	Cap    map[string]int `mapstructure:"cap" yaml:"cap,omitempty"`
+	Strip  []string       `mapstructure:"strip" yaml:"strip,omitempty"`
+}
+
+type BodyLimits struct {
+	Enabled      bool        `mapstructure:"enabled"`
+	MaxBytes     int64       `mapstructure:"max_bytes"`
+	MaxJSONDepth int         `mapstructure:"max_json_depth"`
+	Rules        []BodyLimit `mapstructure:"rules"`
+}
+
+type BodyLimit struct {
+	Routes   []string `mapstructure:"routes" yaml:"routes,omitempty"`
+	MaxBytes int64    `mapstructure:"max_bytes" yaml:"max_bytes,omitempty"`
+	JSON     bool     `mapstructure:"json" yaml:"json,omitempty"`
+}
+
+type ResponseLimits struct {
+	Enabled        bool            `mapstructure:"enabled"`
+	MaxBytes       int64           `mapstructure:"max_bytes"`
+	BufferMaxBytes int64           `mapstructure:"buffer_max_bytes"`
+	Rules          []ResponseLimit `mapstructure:"rules"`
+}
+
+type ResponseLimit struct {
+	Routes   []string `mapstructure:"routes" yaml:"routes,omitempty"`
+	MaxBytes int64    `mapstructure:"max_bytes" yaml:"max_bytes,omitempty"`
+}
+
+type Timeouts struct {
+	DialMs           int       `mapstructure:"dial_ms"`
+	TLSHandshakeMs   int       `mapstructure:"tls_handshake_ms"`
+	ResponseHeaderMs int       `mapstructure:"response_header_ms"`
+	TotalMs          int       `mapstructure:"total_ms"`
+	Rules            []Timeout `mapstructure:"rules"`
+}
+
+type Timeout struct {
+	Routes           []string `mapstructure:"routes" yaml:"routes,omitempty"`
+	ResponseHeaderMs int      `mapstructure:"response_header_ms" yaml:"response_header_ms,omitempty"`
+	TotalMs          int      `mapstructure:"total_ms" yaml:"total_ms,omitempty"`
+}
+
+type Retry struct {
+	Enabled          bool        `mapstructure:"enabled"`
+	MaxAttempts      int         `mapstructure:"max_attempts"`
+	BackoffMs        int         `mapstructure:"backoff_ms"`
+	MaxBackoffMs     int         `mapstructure:"max_backoff_ms"`
+	Jitter           bool        `mapstructure:"jitter"`
+	BudgetPercent    int         `mapstructure:"budget_percent"`
+	BudgetMinRetries int         `mapstructure:"budget_min_retries"`
+	BufferMaxBytes   int64       `mapstructure:"buffer_max_bytes"`
+	Rules            []RetryRule `mapstructure:"rules"`
+}
+
+type RetryRule struct {
+	Routes       []string `mapstructure:"routes" yaml:"routes,omitempty"`
+	Statuses     []int    `mapstructure:"statuses" yaml:"statuses,omitempty"`
+	ErrorKinds   []string `mapstructure:"error_kinds" yaml:"error_kinds,omitempty"`
+	ErrorIDs     []string `mapstructure:"error_ids" yaml:"error_ids,omitempty"`
+	FallbackOnly bool     `mapstructure:"fallback_only" yaml:"fallback_only,omitempty"`
+	Timeouts     bool     `mapstructure:"timeouts" yaml:"timeouts,omitempty"`
+}
+
+type Hedging struct {
+	Enabled    bool        `mapstructure:"enabled"`
+	MinDelayMs int         `mapstructure:"min_delay_ms"`
+	Rules      []HedgeRule `mapstructure:"rules"`
+}
+
+type HedgeRule struct {
+	Routes     []string `mapstructure:"routes" yaml:"routes,omitempty"`
+	Percentile int      `mapstructure:"percentile" yaml:"percentile,omitempty"`
+	DelayMs    int      `mapstructure:"delay_ms" yaml:"delay_ms,omitempty"`
+}
+
+type SessionConsistency struct {
+	Enabled        bool   `mapstructure:"enabled"`
+	KeyHeader      string `mapstructure:"key_header"`
+	TTLSeconds     int    `mapstructure:"ttl_seconds"`
+	PollIntervalMs int    `mapstructure:"poll_interval_ms"`
+	RewriteHead    bool   `mapstructure:"rewrite_head"`
+}
+
+type ChainVerification struct {
+	Enabled              bool   `mapstructure:"enabled"`
+	ExpectedChainID      string `mapstructure:"expected_chain_id"`
+	RetryExpectedChainID string `mapstructure:"retry_expected_chain_id"`
+	IntervalSeconds      int    `mapstructure:"interval_seconds"`
+}
+
+type BlockPinning struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Header  string `mapstructure:"header"`
+}
+
+// Fallback is a node the retries are sent to. It can be written as a host
+// alone.
+type Fallback struct {
+	Host   string `mapstructure:"host" yaml:"host,omitempty"`
+	Weight int    `mapstructure:"weight" yaml:"weight,omitempty"`
+}
+
+type CircuitBreaker struct {
+	Enabled          bool `mapstructure:"enabled"`
+	WindowSeconds    int  `mapstructure:"window_seconds"`
+	MinRequests      int  `mapstructure:"min_requests"`
+	ErrorRate        int  `mapstructure:"error_rate"`
+	SlowMs           int  `mapstructure:"slow_ms"`
+	SlowRate         int  `mapstructure:"slow_rate"`
+	OpenSeconds      int  `mapstructure:"open_seconds"`
+	HalfOpenRequests int  `mapstructure:"half_open_requests"`
+}
+
 type Metrics struct {
 	Host    string `mapstructure:"host"`
 	Enabled bool   `mapstructure:"enabled"`
@@ -85,25 +279,51 @@ type Redis struct {
 	Enabled bool   `mapstructure:"enabled"`
 }
 
+type NormalizePath struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+type ProxyProtocol struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
 type LoadBalancer struct {
 	TTL int `mapstructure:"ttl"`
 }
 
 type ConfigFile struct {
-	DevMode        bool         `mapstructure:"dev_mode"`
-	LoadBalancer   LoadBalancer `mapstructure:"load_balancer"`
-	Redis          Redis        `mapstructure:"redis"`
-	Logger         Logger       `mapstructure:"logger"`
-	RateLimit      RateLimit    `mapstructure:"rate_limit"`
-	Cache          Cache        `mapstructure:"cache"`
-	DenyIPs        DenyIPs      `mapstructure:"deny_ips"`
-	DenyRoutes     DenyRoutes   `mapstructure:"deny_routes"`
-	AllowRoutes    AllowRoutes  `mapstructure:"allow_routes"`
-	Metrics        Metrics      `mapstructure:"metrics"`
-	GC             GC           `mapstructure:"gc"`
-	CORS           CORS         `mapstructure:"cors"`
-	GZIP           GZIP         `mapstructure:"gzip"`
-	Host           string       `mapstructure:"host"`
-	TezosHost      []string     `mapstructure:"tezos_host"`
-	TezosHostRetry string       `mapstructure:"tezos_host_retry"`
+	DevMode            bool               `mapstructure:"dev_mode"`
+	LoadBalancer       LoadBalancer       `mapstructure:"load_balancer"`
+	Redis              Redis              `mapstructure:"redis"`
+	Logger             Logger             `mapstructure:"logger"`
+	RateLimit          RateLimit          `mapstructure:"rate_limit"`
+	Concurrency        ConcurrencyLimit   `mapstructure:"concurrency_limit"`
+	Cache              Cache              `mapstructure:"cache"`
+	DenyIPs            DenyIPs            `mapstructure:"deny_ips"`
+	AllowIPs           AllowIPs           `mapstructure:"allow_ips"`
+	AutoBan            AutoBan            `mapstructure:"auto_ban"`
+	GeoIP              GeoIP              `mapstructure:"geoip"`
+	Admin              Admin              `mapstructure:"admin"`
+	DenyRoutes         DenyRoutes         `mapstructure:"deny_routes"`
+	AllowRoutes        AllowRoutes        `mapstructure:"allow_routes"`
+	QueryPolicies      QueryPolicies      `mapstructure:"query_policies"`
+	BodyLimits         BodyLimits         `mapstructure:"body_limits"`
+	ResponseLimits     ResponseLimits     `mapstructure:"response_limits"`
+	Timeouts           Timeouts           `mapstructure:"timeouts"`
+	Retry              Retry              `mapstructure:"retry"`
+	Hedging            Hedging            `mapstructure:"hedging"`
+	SessionConsistency SessionConsistency `mapstructure:"session_consistency"`
+	BlockPinning       BlockPinning       `mapstructure:"block_pinning"`
+	ChainVerification  ChainVerification  `mapstructure:"chain_verification"`
+	CircuitBreaker     CircuitBreaker     `mapstructure:"circuit_breaker"`
+	Metrics            Metrics            `mapstructure:"metrics"`
+	GC                 GC                 `mapstructure:"gc"`
+	CORS               CORS               `mapstructure:"cors"`
+	GZIP               GZIP               `mapstructure:"gzip"`
+	NormalizePath      NormalizePath      `mapstructure:"normalize_path"`
+	Host               string             `mapstructure:"host"`
+	TrustedProxies     []string           `mapstructure:"trusted_proxies"`
+	ProxyProtocol      ProxyProtocol      `mapstructure:"proxy_protocol"`
+	TezosHost          []string           `mapstructure:"tezos_host"`
+	TezosHostRetry     []Fallback         `mapstructure:"tezos_host_retry"`
 }
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+type queryPolicy struct {
+	QueryPolicy
+	routes *routes.Matcher
+}
+
+// QueryViolation is returned when the query of a request breaks a policy.
+type QueryViolation struct {
+	Status  int
+	Message string
+}
+
+func buildQueryPolicies(rules []QueryPolicy) ([]*queryPolicy, error) {
+	policies := make([]*queryPolicy, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, &queryPolicy{QueryPolicy: rule, routes: matcher})
+	}
+	return policies, nil
+}
+
+// ApplyQueryPolicies checks the query of a request against the policies of
+// its route, in order. Stripped parameters are removed and capped ones are
+// lowered in place; it reports whether the query was changed.
+func (c *Config) ApplyQueryPolicies(method, path string, query url.Values) (bool, *QueryViolation) {
+	if !c.ConfigFile.QueryPolicies.Enabled {
+		return false, nil
+	}
+
+	changed := false
+	for _, policy := range c.QueryPolicies {
+		if !policy.routes.Match(method, path) {
+			continue
+		}
+
+		for _, param := range policy.Strip {
+			if query.Has(param) {
+				query.Del(param)
+				changed = true
+			}
+		}
+		for _, param := range policy.Deny {
+			if query.Has(param) {
+				return changed, &QueryViolation{
+					Status:  http.StatusForbidden,
+					Message: fmt.Sprintf("Query parameter %s is not allowed on this route", param),
+				}
+			}
+		}
+		if len(policy.Allow) > 0 {
+			for param := range query {
+				if !contains(policy.Allow, param) {
+					return changed, &QueryViolation{
+						Status:  http.StatusForbidden,
+						Message: fmt.Sprintf("Query parameter %s is not allowed on this route", param),
+					}
+				}
+			}
+		}
+		for param, max := range policy.Cap {
+			values, has := query[param]
+			if !has {
+				continue
+			}
+			for i, value := range values {
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					return changed, &QueryViolation{
+						Status:  http.StatusBadRequest,
+						Message: fmt.Sprintf("Query parameter %s must be a non-negative integer", param),
+					}
+				}
+				if n > max {
+					values[i] = strconv.Itoa(max)
+					changed = true
+				}
+			}
+		}
+	}
+
+	return changed, nil
+}
+
+// describe summarizes the policy for the explain command.
+func (p *queryPolicy) describe() string {
+	rules := []string{}
+	if len(p.Strip) > 0 {
+		rules = append(rules, "strip "+strings.Join(p.Strip, " "))
+	}
+	if len(p.Deny) > 0 {
+		rules = append(rules, "deny "+strings.Join(p.Deny, " "))
+	}
+	if len(p.Allow) > 0 {
+		rules = append(rules, "allow only "+strings.Join(p.Allow, " "))
+	}
+	params := make([]string, 0, len(p.Cap))
+	for param := range p.Cap {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		rules = append(rules, fmt.Sprintf("cap %s to %d", param, p.Cap[param]))
+	}
+	return strings.Join(rules, ", ")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+type responseLimit struct {
+	ResponseLimit
+	routes *routes.Matcher
+}
+
+func buildResponseLimits(rules []ResponseLimit) ([]*responseLimit, error) {
+	limits := make([]*responseLimit, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, &responseLimit{ResponseLimit: rule, routes: matcher})
+	}
+	return limits, nil
+}
+
+// ResponseLimit returns the maximum size of the upstream response of a
+// request, 0 meaning no limit. The first matching rule is used, otherwise
+// response_limits.max_bytes applies. Streaming routes are never limited.
+func (c *Config) ResponseLimit(method, path string) int64 {
+	if !c.ConfigFile.ResponseLimits.Enabled || streamingRoutes.Match(method, path) {
+		return 0
+	}
+
+	for _, limit := range c.ResponseLimits {
+		if limit.routes.Match(method, path) {
+			return limit.MaxBytes
+		}
+	}
+	return c.ConfigFile.ResponseLimits.MaxBytes
+}
+
+// BufferLimit returns the size above which responses are not cached, 0
+// meaning no limit.
+func (c *Config) BufferLimit() int64 {
+	if !c.ConfigFile.ResponseLimits.Enabled {
+		return 0
+	}
+	return c.ConfigFile.ResponseLimits.BufferMaxBytes
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/concurrency"
+	"github.com/marigold-dev/tzproxy/retry"
+	"github.com/marigold-dev/tzproxy/routes"
+	"github.com/marigold-dev/tzproxy/tezos"
+	"github.com/marigold-dev/tzproxy/transports"
+)
+
+type retryRule struct {
+	RetryRule
+	routes *routes.Matcher
+}
+
+func buildRetryRules(rules []RetryRule) ([]*retryRule, error) {
+	retries := make([]*retryRule, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		retries = append(retries, &retryRule{RetryRule: rule, routes: matcher})
+	}
+	return retries, nil
+}
+
+// applies reports whether the rule can be used, fallback only rules needing
+// a fallback.
+func (r *retryRule) applies(c *Config, method, path string) bool {
+	if r.FallbackOnly && len(c.ConfigFile.TezosHostRetry) == 0 {
+		return false
+	}
+	return r.routes.Match(method, path)
+}
+
+// IsRetryable reports whether a retry rule matches the request, which must
+// then be buffered. Streaming routes are never retried.
+func (c *Config) IsRetryable(method, path string) bool {
+	if !c.ConfigFile.Retry.Enabled || c.ConfigFile.Retry.MaxAttempts <= 1 ||
+		streamingRoutes.Match(method, path) {
+		return false
+	}
+	for _, rule := range c.RetryRules {
+		if rule.applies(c, method, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesErrors reports whether one of the Tezos errors of the response has
+// a kind and an ID of the rule. A rule without kinds nor IDs matches any
+// response.
+func (r *retryRule) matchesErrors(errs []tezos.Error) bool {
+	if len(r.ErrorKinds) == 0 && len(r.ErrorIDs) == 0 {
+		return true
+	}
+	for _, e := range errs {
+		if len(r.ErrorKinds) > 0 && !contains(r.ErrorKinds, e.Kind) {
+			continue
+		}
+		if len(r.ErrorIDs) == 0 {
+			return true
+		}
+		for _, id := range r.ErrorIDs {
+			if e.Is(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MayRetry reports whether a response status can be retried for the
+// request, before its body and so its Tezos errors are known. err is the
+// upstream error, if any.
+func (c *Config) MayRetry(method, path string, status int, err error) bool {
+	if isFinalError(err) {
+		return false
+	}
+	for _, rule := range c.RetryRules {
+		if rule.applies(c, method, path) && rule.matchesStatus(status, err) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldRetry reports whether a response is retried for the request, given
+// its status and Tezos errors, err being the upstream error if any, and
+// whether the retry must go to a fallback. Transport errors are seen as a
+// 502.
+func (c *Config) ShouldRetry(method, path string, status int, errs []tezos.Error, err error) (bool, bool) {
+	if isFinalError(err) {
+		return false, false
+	}
+	retry, fallbackOnly := false, true
+	for _, rule := range c.RetryRules {
+		if rule.applies(c, method, path) && rule.matchesStatus(status, err) && rule.matchesErrors(errs) {
+			retry = true
+			fallbackOnly = fallbackOnly && rule.FallbackOnly
+		}
+	}
+	return retry, fallbackOnly
+}
+
+// isFinalError reports whether the upstream error would happen again on
+// any target: a response too large.
+func isFinalError(err error) bool {
+	return errors.Is(err, transports.ErrResponseTooLarge)
+}
+
+// matchesStatus reports whether the rule retries the status of a response,
+// err being the upstream error if any. The requests that never reached the
+// node, on a connection timeout or a saturated target, count as transport
+// errors and are seen as a 502. The other timeouts, seen as a 504, are only
+// retried by the rules with timeouts set.
+func (r *retryRule) matchesStatus(status int, err error) bool {
+	switch {
+	case errors.Is(err, transports.ErrConnectTimeout) || errors.Is(err, concurrency.ErrLimitReached):
+		status = http.StatusBadGateway
+	case errors.Is(err, transports.ErrUpstreamTimeout):
+		if !r.Timeouts {
+			return false
+		}
+		status = http.StatusGatewayTimeout
+	}
+	return containsStatus(r.Statuses, status)
+}
+
+// RetryBackoff returns the delay before the given retry, counting from 1.
+func (c *Config) RetryBackoff(attempt int) time.Duration {
+	return retry.Backoff(attempt,
+		time.Duration(c.ConfigFile.Retry.BackoffMs)*time.Millisecond,
+		time.Duration(c.ConfigFile.Retry.MaxBackoffMs)*time.Millisecond,
+		c.ConfigFile.Retry.Jitter)
+}
+
+func (c *Config) describeRetry(method, path string) string {
+	if !c.IsRetryable(method, path) {
+		return "none"
+	}
+
+	rules := []string{}
+	for _, rule := range c.RetryRules {
+		if !rule.applies(c, method, path) {
+			continue
+		}
+		statuses := make([]string, 0, len(rule.Statuses))
+		for _, status := range rule.Statuses {
+			statuses = append(statuses, strconv.Itoa(status))
+		}
+		description := strings.Join(statuses, ", ")
+		if filters := append(append([]string{}, rule.ErrorKinds...), rule.ErrorIDs...); len(filters) > 0 {
+			description += " with " + strings.Join(filters, " or ") + " errors"
+		}
+		if rule.Timeouts {
+			description += ", timeouts included"
+		}
+		if rule.FallbackOnly {
+			description += " on fallbacks"
+		}
+		rules = append(rules, description)
+	}
+	return fmt.Sprintf("up to %d attempts on %s", c.ConfigFile.Retry.MaxAttempts, strings.Join(rules, "; "))
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/marigold-dev/tzproxy/concurrency"
+	"github.com/marigold-dev/tzproxy/tezos"
+	"github.com/marigold-dev/tzproxy/transports"
+)
+
+func TestShouldRetry(t *testing.T) {
+	rules := []RetryRule{
+		{
+			Routes:   []string{"GET /chains/{chain}/blocks/{block}/**"},
+			Statuses: []int{502, 503, 504},
+		},
+		{
+			Routes:     []string{"GET /chains/{chain}/blocks/{block}/**"},
+			Statuses:   []int{500},
+			ErrorKinds: []string{tezos.KindTemporary},
+		},
+		{
+			Routes:       []string{"GET /chains/{chain}/blocks/{block}/**"},
+			Statuses:     []int{404},
+			FallbackOnly: true,
+		},
+		{
+			Routes:   []string{"POST /chains/{chain}/blocks/{block}/helpers/scripts/**"},
+			Statuses: []int{500},
+			ErrorIDs: []string{"contract.non_existing_contract"},
+		},
+		{
+			Routes:   []string{"GET /chains/{chain}/blocks/{block}/context/**"},
+			Statuses: []int{504},
+			Timeouts: true,
+		},
+	}
+	retryRules, err := buildRetryRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const block = "/chains/main/blocks/head/header"
+	const script = "/chains/main/blocks/head/helpers/scripts/run_operation"
+	const constants = "/chains/main/blocks/head/context/constants"
+	connectTimeout := fmt.Errorf("%w: %w", transports.ErrUpstreamTimeout, transports.ErrConnectTimeout)
+	headerTimeout := fmt.Errorf("%w: header", transports.ErrUpstreamTimeout)
+	temporary := []tezos.Error{{Kind: tezos.KindTemporary, ID: "node.mempool.request_conflict"}}
+	permanent := []tezos.Error{{Kind: tezos.KindPermanent, ID: "proto.alpha.contract.non_existing_contract"}}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		status       int
+		errs         []tezos.Error
+		err          error
+		fallbacks    bool
+		want         bool
+		fallbackOnly bool
+	}{
+		{name: "gateway error", method: "GET", path: block, status: 503, want: true},
+		{name: "transport error", method: "GET", path: block, status: 502, err: errors.New("connection refused"), want: true},
+		{name: "success", method: "GET", path: block, status: 200},
+		{name: "other route", method: "GET", path: "/version", status: 503},
+		{name: "other method", method: "POST", path: block, status: 503},
+		{name: "temporary error", method: "GET", path: block, status: 500, errs: temporary, want: true},
+		{name: "permanent error", method: "GET", path: block, status: 500, errs: permanent},
+		{name: "error id", method: "POST", path: script, status: 500, errs: permanent, want: true},
+		{name: "other error id", method: "POST", path: script, status: 500, errs: temporary},
+		{name: "fallback only without fallback", method: "GET", path: block, status: 404},
+		{name: "fallback only", method: "GET", path: block, status: 404, fallbacks: true, want: true, fallbackOnly: true},
+		{name: "saturated target", method: "GET", path: block, status: 429, err: concurrency.ErrLimitReached, want: true},
+		{name: "connect timeout", method: "GET", path: block, status: 504, err: connectTimeout, want: true},
+		{name: "header timeout", method: "GET", path: block, status: 504, err: headerTimeout},
+		{name: "header timeout with timeouts", method: "GET", path: constants, status: 504, err: headerTimeout, want: true},
+		{name: "gateway timeout of the node", method: "GET", path: constants, status: 504, want: true},
+		{name: "response too large", method: "GET", path: block, status: 502, err: transports.ErrResponseTooLarge},
+		{name: "canceled", method: "GET", path: block, status: 502, err: context.Canceled, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				ConfigFile: &ConfigFile{Retry: Retry{Enabled: true, MaxAttempts: 3, Rules: rules}},
+				RetryRules: retryRules,
+			}
+			if tt.fallbacks {
+				c.ConfigFile.TezosHostRetry = []Fallback{{Host: "127.0.0.1:8733"}}
+			}
+
+			retry, fallbackOnly := c.ShouldRetry(tt.method, tt.path, tt.status, tt.errs, tt.err)
+			if retry != tt.want {
+				t.Errorf("retry = %v, want %v", retry, tt.want)
+			}
+			if retry && fallbackOnly != tt.fallbackOnly {
+				t.Errorf("fallback only = %v, want %v", fallbackOnly, tt.fallbackOnly)
+			}
+		})
+	}
+}
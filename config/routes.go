@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+// streamingRoutes are never cached nor buffered for a retry: monitor
+// responses are streamed and the mempool changes all the time.
+var streamingRoutes = routes.MustCompile(
+	"* /monitor/**",
+	"* /chains/{chain}/mempool/**",
+)
+
+// IsRouteAllowed reports whether allow_routes lets the request through.
+func (c *Config) IsRouteAllowed(method, path string) bool {
+	if !c.ConfigFile.AllowRoutes.Enabled || method == http.MethodOptions {
+		return true
+	}
+	return c.AllowRoutes.Match(method, path)
+}
+
+// IsRouteDenied reports whether deny_routes blocks the request.
+func (c *Config) IsRouteDenied(method, path string) bool {
+	if !c.ConfigFile.DenyRoutes.Enabled {
+		return false
+	}
+	return c.DenyRoutes.Match(method, path)
+}
+
+// IsCacheable reports whether the response of the request can be cached.
+func (c *Config) IsCacheable(method, path string) bool {
+	if !c.ConfigFile.Cache.Enabled ||
+		method != http.MethodGet ||
+		streamingRoutes.Match(method, path) {
+		return false
+	}
+	return !c.CacheDisabledRoutes.Match(method, path)
+}
+
+// buildRoutes compiles the route rules of the configuration file. The state
+// of the rules of previous, if set, is kept.
+func buildRoutes(c *Config, previous *Config) error {
+	var err error
+
+	c.AllowRoutes, err = routes.Compile(c.ConfigFile.AllowRoutes.Values)
+	if err != nil {
+		return fmt.Errorf("allow_routes: %w", err)
+	}
+	c.DenyRoutes, err = routes.Compile(c.ConfigFile.DenyRoutes.Values)
+	if err != nil {
+		return fmt.Errorf("deny_routes: %w", err)
+	}
+	c.CacheDisabledRoutes, err = routes.Compile(c.ConfigFile.Cache.DisabledRoutes)
+	if err != nil {
+		return fmt.Errorf("cache.disabled_routes: %w", err)
+	}
+	c.QueryPolicies, err = buildQueryPolicies(c.ConfigFile.QueryPolicies.Rules)
+	if err != nil {
+		return fmt.Errorf("query_policies: %w", err)
+	}
+	c.BodyLimits, err = buildBodyLimits(c.ConfigFile.BodyLimits.Rules)
+	if err != nil {
+		return fmt.Errorf("body_limits: %w", err)
+	}
+	c.ResponseLimits, err = buildResponseLimits(c.ConfigFile.ResponseLimits.Rules)
+	if err != nil {
+		return fmt.Errorf("response_limits: %w", err)
+	}
+	c.Timeouts, err = buildTimeouts(c.ConfigFile.Timeouts.Rules)
+	if err != nil {
+		return fmt.Errorf("timeouts: %w", err)
+	}
+	c.RetryRules, err = buildRetryRules(c.ConfigFile.Retry.Rules)
+	if err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	var previousHedges []*hedgeRule
+	if previous != nil {
+		previousHedges = previous.HedgeRules
+	}
+	c.HedgeRules, err = buildHedgeRules(c.ConfigFile.Hedging.Rules, previousHedges)
+	if err != nil {
+		return fmt.Errorf("hedging: %w", err)
+	}
+
+	return nil
+}
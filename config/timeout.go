@@ -0,0 +1,66 @@
+package config
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/routes"
+)
+
+type timeoutRule struct {
+	Timeout
+	routes *routes.Matcher
+}
+
+func buildTimeouts(rules []Timeout) ([]*timeoutRule, error) {
+	timeouts := make([]*timeoutRule, 0, len(rules))
+	for _, rule := range rules {
+		matcher, err := routes.Compile(rule.Routes)
+		if err != nil {
+			return nil, err
+		}
+		timeouts = append(timeouts, &timeoutRule{Timeout: rule, routes: matcher})
+	}
+	return timeouts, nil
+}
+
+// Timeout returns the response header and total timeouts of a request, 0
+// meaning no timeout. The first matching rule overrides the timeouts it
+// sets. Streaming routes have no total timeout.
+func (c *Config) Timeout(method, path string) (time.Duration, time.Duration) {
+	header := c.ConfigFile.Timeouts.ResponseHeaderMs
+	total := c.ConfigFile.Timeouts.TotalMs
+	for _, timeout := range c.Timeouts {
+		if timeout.routes.Match(method, path) {
+			if timeout.ResponseHeaderMs > 0 {
+				header = timeout.ResponseHeaderMs
+			}
+			if timeout.TotalMs > 0 {
+				total = timeout.TotalMs
+			}
+			break
+		}
+	}
+	if streamingRoutes.Match(method, path) {
+		total = 0
+	}
+
+	return time.Duration(header) * time.Millisecond, time.Duration(total) * time.Millisecond
+}
+
+// buildTransport creates the connection pool to the nodes, or keeps the
+// previous one since its timeouts are only read at startup.
+func buildTransport(configFile *ConfigFile, previous *Config) *http.Transport {
+	if previous != nil && previous.Transport != nil {
+		return previous.Transport
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(configFile.Timeouts.DialMs) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = time.Duration(configFile.Timeouts.TLSHandshakeMs) * time.Millisecond
+	return transport
+}
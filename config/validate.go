@@ -0,0 +1,448 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/marigold-dev/tzproxy/routes"
+	"github.com/marigold-dev/tzproxy/tezos"
+	"gopkg.in/yaml.v3"
+)
+
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Key     string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d:%d: %s: %s", e.File, e.Line, e.Column, e.Key, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Key, e.Message)
+}
+
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// validator checks a configuration and reports problems at the position of
+// the offending key in the file, when the value comes from the file.
+type validator struct {
+	file      string
+	root      *yaml.Node
+	locations map[string]*yaml.Node
+	errs      ValidationErrors
+}
+
+func newValidator(file string) (*validator, error) {
+	v := &validator{
+		file:      file,
+		locations: make(map[string]*yaml.Node),
+	}
+	if file == "" {
+		return v, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) > 0 {
+		v.root = document.Content[0]
+		v.index("", v.root)
+	}
+
+	return v, nil
+}
+
+func (v *validator) index(key string, node *yaml.Node) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := strings.ToLower(node.Content[i].Value)
+			if key != "" {
+				name = key + "." + name
+			}
+			v.locations[name] = node.Content[i+1]
+			v.index(name, node.Content[i+1])
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			name := fmt.Sprintf("%s[%d]", key, i)
+			v.locations[name] = item
+			v.index(name, item)
+		}
+	}
+}
+
+func (v *validator) fail(key, format string, args ...interface{}) {
+	err := &ValidationError{
+		File:    v.file,
+		Key:     key,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if node, has := v.locations[key]; has {
+		err.Line = node.Line
+		err.Column = node.Column
+	}
+	v.errs = append(v.errs, err)
+}
+
+func (v *validator) validate(cf *ConfigFile) ValidationErrors {
+	if v.root != nil {
+		v.checkKeys("", v.root, reflect.TypeOf(*cf))
+	}
+
+	v.checkAddress("host", cf.Host)
+	if len(cf.TezosHost) == 0 {
+		v.fail("tezos_host", "must have at least one host")
+	}
+	for i, host := range cf.TezosHost {
+		v.checkTezosHost(fmt.Sprintf("tezos_host[%d]", i), host)
+	}
+	for i, fallback := range cf.TezosHostRetry {
+		key := fmt.Sprintf("tezos_host_retry[%d]", i)
+		v.checkTezosHost(key+".host", fallback.Host)
+		v.checkNotNegative(key+".weight", fallback.Weight)
+	}
+	v.checkCIDRs("trusted_proxies", cf.TrustedProxies)
+	// Anybody could otherwise send a PROXY header and spoof its IP
+	if cf.ProxyProtocol.Enabled && len(cf.TrustedProxies) == 0 {
+		v.fail("proxy_protocol.enabled", "requires trusted_proxies")
+	}
+
+	if cf.Redis.Enabled {
+		v.checkAddress("redis.host", cf.Redis.Host)
+	}
+	v.checkNotNegative("load_balancer.ttl", cf.LoadBalancer.TTL)
+	v.checkNotNegative("logger.bunch_size", cf.Logger.BunchSize)
+	v.checkNotNegative("logger.pool_interval_seconds", cf.Logger.PoolIntervalSeconds)
+
+	if cf.RateLimit.Minutes <= 0 {
+		v.fail("rate_limit.minutes", "must be positive")
+	}
+	v.checkNotNegative("rate_limit.max", cf.RateLimit.Max)
+
+	v.checkNotNegative("concurrency_limit.max_per_client", cf.Concurrency.MaxPerClient)
+	v.checkNotNegative("concurrency_limit.max_per_target", cf.Concurrency.MaxPerTarget)
+	v.checkNotNegative("concurrency_limit.queue_timeout_ms", cf.Concurrency.QueueTimeoutMs)
+
+	v.checkNotNegative("cache.ttl", cf.Cache.TTL)
+	if cf.Cache.Enabled && cf.Cache.SizeMB <= 0 {
+		v.fail("cache.size_mb", "must be positive")
+	}
+	v.checkRoutes("cache.disabled_routes", cf.Cache.DisabledRoutes)
+	v.checkRoutes("allow_routes.values", cf.AllowRoutes.Values)
+	v.checkRoutes("deny_routes.values", cf.DenyRoutes.Values)
+	for i, policy := range cf.QueryPolicies.Rules {
+		key := fmt.Sprintf("query_policies.rules[%d]", i)
+		if len(policy.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", policy.Routes)
+		for param, max := range policy.Cap {
+			v.checkNotNegative(key+".cap."+param, max)
+		}
+	}
+	if cf.BodyLimits.MaxBytes < 0 {
+		v.fail("body_limits.max_bytes", "must not be negative")
+	}
+	v.checkNotNegative("body_limits.max_json_depth", cf.BodyLimits.MaxJSONDepth)
+	for i, limit := range cf.BodyLimits.Rules {
+		key := fmt.Sprintf("body_limits.rules[%d]", i)
+		if len(limit.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", limit.Routes)
+		if limit.MaxBytes < 0 {
+			v.fail(key+".max_bytes", "must not be negative")
+		}
+	}
+	if cf.ResponseLimits.MaxBytes < 0 {
+		v.fail("response_limits.max_bytes", "must not be negative")
+	}
+	if cf.ResponseLimits.BufferMaxBytes < 0 {
+		v.fail("response_limits.buffer_max_bytes", "must not be negative")
+	}
+	for i, limit := range cf.ResponseLimits.Rules {
+		key := fmt.Sprintf("response_limits.rules[%d]", i)
+		if len(limit.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", limit.Routes)
+		if limit.MaxBytes < 0 {
+			v.fail(key+".max_bytes", "must not be negative")
+		}
+	}
+	v.checkNotNegative("timeouts.dial_ms", cf.Timeouts.DialMs)
+	v.checkNotNegative("timeouts.tls_handshake_ms", cf.Timeouts.TLSHandshakeMs)
+	v.checkNotNegative("timeouts.response_header_ms", cf.Timeouts.ResponseHeaderMs)
+	v.checkNotNegative("timeouts.total_ms", cf.Timeouts.TotalMs)
+	for i, timeout := range cf.Timeouts.Rules {
+		key := fmt.Sprintf("timeouts.rules[%d]", i)
+		if len(timeout.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", timeout.Routes)
+		v.checkNotNegative(key+".response_header_ms", timeout.ResponseHeaderMs)
+		v.checkNotNegative(key+".total_ms", timeout.TotalMs)
+	}
+	if cf.Retry.Enabled && cf.Retry.MaxAttempts <= 0 {
+		v.fail("retry.max_attempts", "must be positive")
+	}
+	v.checkNotNegative("retry.backoff_ms", cf.Retry.BackoffMs)
+	v.checkNotNegative("retry.max_backoff_ms", cf.Retry.MaxBackoffMs)
+	v.checkNotNegative("retry.budget_min_retries", cf.Retry.BudgetMinRetries)
+	v.checkPercent("retry.budget_percent", cf.Retry.BudgetPercent)
+	if cf.Retry.BufferMaxBytes < 0 {
+		v.fail("retry.buffer_max_bytes", "must not be negative")
+	}
+	for i, rule := range cf.Retry.Rules {
+		key := fmt.Sprintf("retry.rules[%d]", i)
+		if len(rule.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", rule.Routes)
+		if len(rule.Statuses) == 0 {
+			v.fail(key+".statuses", "must have at least one status")
+		}
+		for j, kind := range rule.ErrorKinds {
+			if kind != tezos.KindTemporary && kind != tezos.KindBranch && kind != tezos.KindPermanent {
+				v.fail(fmt.Sprintf("%s.error_kinds[%d]", key, j), "must be temporary, branch or permanent")
+			}
+		}
+		for j, status := range rule.Statuses {
+			if status < 100 || status > 599 {
+				v.fail(fmt.Sprintf("%s.statuses[%d]", key, j), "must be an HTTP status code")
+			}
+		}
+	}
+	v.checkNotNegative("hedging.min_delay_ms", cf.Hedging.MinDelayMs)
+	for i, rule := range cf.Hedging.Rules {
+		key := fmt.Sprintf("hedging.rules[%d]", i)
+		if len(rule.Routes) == 0 {
+			v.fail(key+".routes", "must have at least one route")
+		}
+		v.checkRoutes(key+".routes", rule.Routes)
+		for j, route := range rule.Routes {
+			// Only idempotent requests can be sent twice
+			if !strings.HasPrefix(route, http.MethodGet+" ") && !strings.HasPrefix(route, http.MethodGet+"/") {
+				v.fail(fmt.Sprintf("%s.routes[%d]", key, j), "must be a GET route")
+			}
+		}
+		if rule.Percentile <= 0 || rule.Percentile >= 100 {
+			v.fail(key+".percentile", "must be between 1 and 99")
+		}
+		v.checkNotNegative(key+".delay_ms", rule.DelayMs)
+	}
+	if cf.SessionConsistency.Enabled {
+		if cf.SessionConsistency.TTLSeconds <= 0 {
+			v.fail("session_consistency.ttl_seconds", "must be positive")
+		}
+	}
+	if cf.BlockPinning.Enabled && cf.BlockPinning.Header == "" {
+		v.fail("block_pinning.header", "must not be empty")
+	}
+	if (cf.SessionConsistency.Enabled || cf.BlockPinning.Enabled) && cf.SessionConsistency.PollIntervalMs <= 0 {
+		v.fail("session_consistency.poll_interval_ms", "must be positive")
+	}
+	if cf.ChainVerification.Enabled {
+		if !tezos.IsChainID(cf.ChainVerification.ExpectedChainID) {
+			v.fail("chain_verification.expected_chain_id", "must be a chain id")
+		}
+		if cf.ChainVerification.RetryExpectedChainID != "" && !tezos.IsChainID(cf.ChainVerification.RetryExpectedChainID) {
+			v.fail("chain_verification.retry_expected_chain_id", "must be a chain id")
+		}
+		if cf.ChainVerification.IntervalSeconds <= 0 {
+			v.fail("chain_verification.interval_seconds", "must be positive")
+		}
+	}
+	if cf.CircuitBreaker.Enabled {
+		if cf.CircuitBreaker.WindowSeconds <= 0 {
+			v.fail("circuit_breaker.window_seconds", "must be positive")
+		}
+		if cf.CircuitBreaker.OpenSeconds <= 0 {
+			v.fail("circuit_breaker.open_seconds", "must be positive")
+		}
+		if cf.CircuitBreaker.HalfOpenRequests <= 0 {
+			v.fail("circuit_breaker.half_open_requests", "must be positive")
+		}
+	}
+	v.checkNotNegative("circuit_breaker.min_requests", cf.CircuitBreaker.MinRequests)
+	v.checkNotNegative("circuit_breaker.slow_ms", cf.CircuitBreaker.SlowMs)
+	v.checkPercent("circuit_breaker.error_rate", cf.CircuitBreaker.ErrorRate)
+	v.checkPercent("circuit_breaker.slow_rate", cf.CircuitBreaker.SlowRate)
+
+	v.checkCIDRs("deny_ips.values", cf.DenyIPs.Values)
+	v.checkCIDRs("allow_ips.values", cf.AllowIPs.Values)
+
+	if cf.AutoBan.Enabled {
+		if cf.AutoBan.WindowSeconds <= 0 {
+			v.fail("auto_ban.window_seconds", "must be positive")
+		}
+		if cf.AutoBan.BanSeconds <= 0 {
+			v.fail("auto_ban.ban_seconds", "must be positive")
+		}
+	}
+	v.checkNotNegative("auto_ban.max_forbidden", cf.AutoBan.MaxForbidden)
+	v.checkNotNegative("auto_ban.max_rate_limited", cf.AutoBan.MaxRateLimited)
+	v.checkNotNegative("auto_ban.max_bad_injections", cf.AutoBan.MaxBadInjections)
+
+	if cf.GeoIP.Enabled {
+		v.checkFile("geoip.database", cf.GeoIP.Database)
+		if cf.GeoIP.ASNDatabase != "" {
+			v.checkFile("geoip.asn_database", cf.GeoIP.ASNDatabase)
+		} else if len(cf.GeoIP.AllowASNs) > 0 || len(cf.GeoIP.DenyASNs) > 0 {
+			v.fail("geoip.asn_database", "is required by the ASN rules")
+		}
+	}
+	v.checkCountries("geoip.allow_countries", cf.GeoIP.AllowCountries)
+	v.checkCountries("geoip.deny_countries", cf.GeoIP.DenyCountries)
+	v.checkCountries("geoip.rate_limit_countries", cf.GeoIP.RateLimitCountries)
+	v.checkNotNegative("geoip.rate_limit_max", cf.GeoIP.RateLimitMax)
+
+	if cf.Metrics.Enabled {
+		v.checkAddress("metrics.host", cf.Metrics.Host)
+	}
+	if cf.Admin.Enabled {
+		v.checkAddress("admin.host", cf.Admin.Host)
+	}
+	if cf.GC.Percent <= 0 {
+		v.fail("gc.percent", "must be positive")
+	}
+
+	return v.errs
+}
+
+// checkKeys reports keys of the file that don't exist in the configuration.
+func (v *validator) checkKeys(key string, node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if name := t.Field(i).Tag.Get("mapstructure"); name != "" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := strings.ToLower(node.Content[i].Value)
+			path := name
+			if key != "" {
+				path = key + "." + name
+			}
+			fieldType, has := fields[name]
+			if !has {
+				err := &ValidationError{
+					File:    v.file,
+					Line:    node.Content[i].Line,
+					Column:  node.Content[i].Column,
+					Key:     path,
+					Message: "unknown key",
+				}
+				v.errs = append(v.errs, err)
+				continue
+			}
+			v.checkKeys(path, node.Content[i+1], fieldType)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			path := key + "." + strings.ToLower(node.Content[i].Value)
+			v.checkKeys(path, node.Content[i+1], t.Elem())
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			v.checkKeys(fmt.Sprintf("%s[%d]", key, i), item, t.Elem())
+		}
+	}
+}
+
+func (v *validator) checkNotNegative(key string, value int) {
+	if value < 0 {
+		v.fail(key, "must not be negative")
+	}
+}
+
+func (v *validator) checkPercent(key string, value int) {
+	if value < 0 || value > 100 {
+		v.fail(key, "must be a percentage between 0 and 100")
+	}
+}
+
+func (v *validator) checkAddress(key, address string) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.fail(key, "invalid address %q: %v", address, err)
+		return
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		v.fail(key, "invalid port %q", port)
+	}
+}
+
+func (v *validator) checkTezosHost(key, host string) {
+	target, err := hostToTarget(host)
+	if err != nil {
+		v.fail(key, "%v", err)
+		return
+	}
+	if target.URL.Host == "" {
+		v.fail(key, "invalid host %q", host)
+	}
+}
+
+func (v *validator) checkCIDRs(key string, values []string) {
+	for i, value := range values {
+		if _, err := parseCIDR(value); err != nil {
+			v.fail(fmt.Sprintf("%s[%d]", key, i), "invalid IP or CIDR range %q", value)
+		}
+	}
+}
+
+func (v *validator) checkRoutes(key string, values []string) {
+	for i, value := range values {
+		if _, err := routes.Compile([]string{value}); err != nil {
+			v.fail(fmt.Sprintf("%s[%d]", key, i), "%v", err)
+		}
+	}
+}
+
+func (v *validator) checkCountries(key string, values []string) {
+	for i, value := range values {
+		if len(value) != 2 || strings.ToUpper(value) != value {
+			v.fail(fmt.Sprintf("%s[%d]", key, i), "invalid ISO country code %q", value)
+		}
+	}
+}
+
+func (v *validator) checkFile(key, path string) {
+	if path == "" {
+		v.fail(key, "is required")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.fail(key, "%v", err)
+	}
+}
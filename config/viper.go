@@ -1,28 +1,63 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"strings"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 )
 
-func initViper() *ConfigFile {
+// Options tells where to find the configuration and which settings to
+// override on top of it.
+type Options struct {
+	// File is the path of the configuration file. When empty, tzproxy.yaml
+	// (or tzproxy.dev.yaml) is looked up in the working directory.
+	File string
+	// Overrides are settings applied over the file and the environment,
+	// by key, e.g. "cache.ttl".
+	Overrides map[string]string
+}
+
+func initViper(options Options) *ConfigFile {
+	if err := setupViper(options); err != nil {
+		log.Logger.Fatal().Err(err).Msg("unable to load configuration")
+	}
+
+	configFile, err := readConfigFile()
+	if err != nil {
+		if errs, ok := err.(ValidationErrors); ok {
+			for _, err := range errs {
+				log.Logger.Error().Msg(err.Error())
+			}
+		}
+		log.Logger.Fatal().Err(err).Msg("unable to load configuration")
+	}
+	viper.WatchConfig()
+
+	return configFile
+}
 
+func setupViper(options Options) error {
 	// Set the configuration file name and path
-	viper.SetConfigName("tzproxy")
 	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
+	if options.File != "" {
+		viper.SetConfigFile(options.File)
+	} else {
+		viper.SetConfigName("tzproxy")
+		viper.AddConfigPath(".")
 
-	// Check if the tzproxy.dev.yaml configuration file exists
-	if _, err := os.Stat("tzproxy.dev.yaml"); err == nil {
-		viper.SetConfigName("tzproxy.dev")
+		// Check if the tzproxy.dev.yaml configuration file exists
+		if _, err := os.Stat("tzproxy.dev.yaml"); err == nil {
+			viper.SetConfigName("tzproxy.dev")
+		}
 	}
 
-	// Read the configuration file
-	viper.ReadInConfig()
-
 	// Set the environment variables prefix
 	viper.SetEnvPrefix("TZPROXY")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
@@ -30,44 +65,203 @@ func initViper() *ConfigFile {
 	viper.SetTypeByDefaultValue(true)
 
 	// Set default values for configuration
-	viper.SetDefault("dev_mode", false)
-	viper.SetDefault("host", defaultConfig.Host)
-	viper.SetDefault("tezos_host", defaultConfig.TezosHost)
-	viper.SetDefault("tezos_host_retry", defaultConfig.TezosHostRetry)
-	viper.SetDefault("redis.host", defaultConfig.Redis.Host)
-	viper.SetDefault("redis.enabled", defaultConfig.Redis.Enabled)
-	viper.SetDefault("load_balancer.ttl", defaultConfig.LoadBalancer.TTL)
-	viper.SetDefault("logger.bunch_size", defaultConfig.Logger.BunchSize)
-	viper.SetDefault("logger.pool_interval_seconds", defaultConfig.Logger.PoolIntervalSeconds)
-	viper.SetDefault("cache.enabled", defaultConfig.Cache.Enabled)
-	viper.SetDefault("cache.ttl", defaultConfig.Cache.TTL)
-	viper.SetDefault("cache.disabled_routes", defaultConfig.Cache.DisabledRoutes)
-	viper.SetDefault("cache.size_mb", defaultConfig.Cache.SizeMB)
-	viper.SetDefault("rate_limit.enabled", defaultConfig.RateLimit.Enabled)
-	viper.SetDefault("rate_limit.minutes", defaultConfig.RateLimit.Minutes)
-	viper.SetDefault("rate_limit.max", defaultConfig.RateLimit.Max)
-	viper.SetDefault("deny_ips.enabled", defaultConfig.DenyIPs.Enabled)
-	viper.SetDefault("deny_ips.values", defaultConfig.DenyIPs.Values)
-	viper.SetDefault("deny_routes.enabled", defaultConfig.DenyRoutes.Enabled)
-	viper.SetDefault("deny_routes.values", defaultConfig.DenyRoutes.Values)
-	viper.SetDefault("allow_routes.enabled", defaultConfig.AllowRoutes.Enabled)
-	viper.SetDefault("allow_routes.values", defaultConfig.AllowRoutes.Values)
-	viper.SetDefault("metrics.enabled", defaultConfig.Metrics.Enabled)
-	viper.SetDefault("metrics.pprof", defaultConfig.Metrics.Pprof)
-	viper.SetDefault("metrics.host", defaultConfig.Metrics.Host)
-	viper.SetDefault("cors.enabled", defaultConfig.CORS.Enabled)
-	viper.SetDefault("gzip.enabled", defaultConfig.GZIP.Enabled)
-	viper.SetDefault("gc.optimize_memory_store", defaultConfig.GC.OptimizeMemoryStore)
-	viper.SetDefault("gc.percent", defaultConfig.GC.Percent)
+	setDefaults(viper.GetViper())
+
+	// Apply the overrides, they take precedence over everything else
+	for key, value := range options.Overrides {
+		if !viper.IsSet(key) {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		viper.Set(key, value)
+	}
+
+	return nil
+}
+
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("dev_mode", false)
+	v.SetDefault("host", defaultConfig.Host)
+	v.SetDefault("tezos_host", defaultConfig.TezosHost)
+	v.SetDefault("tezos_host_retry", defaultConfig.TezosHostRetry)
+	v.SetDefault("trusted_proxies", defaultConfig.TrustedProxies)
+	v.SetDefault("proxy_protocol.enabled", defaultConfig.ProxyProtocol.Enabled)
+	v.SetDefault("redis.host", defaultConfig.Redis.Host)
+	v.SetDefault("redis.enabled", defaultConfig.Redis.Enabled)
+	v.SetDefault("load_balancer.ttl", defaultConfig.LoadBalancer.TTL)
+	v.SetDefault("logger.bunch_size", defaultConfig.Logger.BunchSize)
+	v.SetDefault("logger.pool_interval_seconds", defaultConfig.Logger.PoolIntervalSeconds)
+	v.SetDefault("cache.enabled", defaultConfig.Cache.Enabled)
+	v.SetDefault("cache.ttl", defaultConfig.Cache.TTL)
+	v.SetDefault("cache.disabled_routes", defaultConfig.Cache.DisabledRoutes)
+	v.SetDefault("cache.size_mb", defaultConfig.Cache.SizeMB)
+	v.SetDefault("rate_limit.enabled", defaultConfig.RateLimit.Enabled)
+	v.SetDefault("rate_limit.minutes", defaultConfig.RateLimit.Minutes)
+	v.SetDefault("rate_limit.max", defaultConfig.RateLimit.Max)
+	v.SetDefault("rate_limit.fail_open", defaultConfig.RateLimit.FailOpen)
+	v.SetDefault("concurrency_limit.enabled", defaultConfig.Concurrency.Enabled)
+	v.SetDefault("concurrency_limit.key_header", defaultConfig.Concurrency.KeyHeader)
+	v.SetDefault("concurrency_limit.max_per_client", defaultConfig.Concurrency.MaxPerClient)
+	v.SetDefault("concurrency_limit.max_per_target", defaultConfig.Concurrency.MaxPerTarget)
+	v.SetDefault("concurrency_limit.queue_timeout_ms", defaultConfig.Concurrency.QueueTimeoutMs)
+	v.SetDefault("deny_ips.enabled", defaultConfig.DenyIPs.Enabled)
+	v.SetDefault("deny_ips.values", defaultConfig.DenyIPs.Values)
+	v.SetDefault("allow_ips.enabled", defaultConfig.AllowIPs.Enabled)
+	v.SetDefault("allow_ips.values", defaultConfig.AllowIPs.Values)
+	v.SetDefault("allow_ips.bypass_rate_limit", defaultConfig.AllowIPs.BypassRateLimit)
+	v.SetDefault("geoip.enabled", defaultConfig.GeoIP.Enabled)
+	v.SetDefault("geoip.database", defaultConfig.GeoIP.Database)
+	v.SetDefault("geoip.asn_database", defaultConfig.GeoIP.ASNDatabase)
+	v.SetDefault("geoip.allow_countries", defaultConfig.GeoIP.AllowCountries)
+	v.SetDefault("geoip.deny_countries", defaultConfig.GeoIP.DenyCountries)
+	v.SetDefault("geoip.allow_asns", defaultConfig.GeoIP.AllowASNs)
+	v.SetDefault("geoip.deny_asns", defaultConfig.GeoIP.DenyASNs)
+	v.SetDefault("geoip.rate_limit_countries", defaultConfig.GeoIP.RateLimitCountries)
+	v.SetDefault("geoip.rate_limit_max", defaultConfig.GeoIP.RateLimitMax)
+	v.SetDefault("auto_ban.enabled", defaultConfig.AutoBan.Enabled)
+	v.SetDefault("auto_ban.window_seconds", defaultConfig.AutoBan.WindowSeconds)
+	v.SetDefault("auto_ban.ban_seconds", defaultConfig.AutoBan.BanSeconds)
+	v.SetDefault("auto_ban.max_forbidden", defaultConfig.AutoBan.MaxForbidden)
+	v.SetDefault("auto_ban.max_rate_limited", defaultConfig.AutoBan.MaxRateLimited)
+	v.SetDefault("auto_ban.max_bad_injections", defaultConfig.AutoBan.MaxBadInjections)
+	v.SetDefault("deny_routes.enabled", defaultConfig.DenyRoutes.Enabled)
+	v.SetDefault("deny_routes.values", defaultConfig.DenyRoutes.Values)
+	v.SetDefault("allow_routes.enabled", defaultConfig.AllowRoutes.Enabled)
+	v.SetDefault("allow_routes.values", defaultConfig.AllowRoutes.Values)
+	v.SetDefault("query_policies.enabled", defaultConfig.QueryPolicies.Enabled)
+	v.SetDefault("query_policies.rules", defaultConfig.QueryPolicies.Rules)
+	v.SetDefault("body_limits.enabled", defaultConfig.BodyLimits.Enabled)
+	v.SetDefault("body_limits.max_bytes", defaultConfig.BodyLimits.MaxBytes)
+	v.SetDefault("body_limits.max_json_depth", defaultConfig.BodyLimits.MaxJSONDepth)
+	v.SetDefault("body_limits.rules", defaultConfig.BodyLimits.Rules)
+	v.SetDefault("response_limits.enabled", defaultConfig.ResponseLimits.Enabled)
+	v.SetDefault("response_limits.max_bytes", defaultConfig.ResponseLimits.MaxBytes)
+	v.SetDefault("response_limits.buffer_max_bytes", defaultConfig.ResponseLimits.BufferMaxBytes)
+	v.SetDefault("response_limits.rules", defaultConfig.ResponseLimits.Rules)
+	v.SetDefault("timeouts.dial_ms", defaultConfig.Timeouts.DialMs)
+	v.SetDefault("timeouts.tls_handshake_ms", defaultConfig.Timeouts.TLSHandshakeMs)
+	v.SetDefault("timeouts.response_header_ms", defaultConfig.Timeouts.ResponseHeaderMs)
+	v.SetDefault("timeouts.total_ms", defaultConfig.Timeouts.TotalMs)
+	v.SetDefault("timeouts.rules", defaultConfig.Timeouts.Rules)
+	v.SetDefault("retry.enabled", defaultConfig.Retry.Enabled)
+	v.SetDefault("retry.max_attempts", defaultConfig.Retry.MaxAttempts)
+	v.SetDefault("retry.backoff_ms", defaultConfig.Retry.BackoffMs)
+	v.SetDefault("retry.max_backoff_ms", defaultConfig.Retry.MaxBackoffMs)
+	v.SetDefault("retry.jitter", defaultConfig.Retry.Jitter)
+	v.SetDefault("retry.budget_percent", defaultConfig.Retry.BudgetPercent)
+	v.SetDefault("retry.budget_min_retries", defaultConfig.Retry.BudgetMinRetries)
+	v.SetDefault("retry.buffer_max_bytes", defaultConfig.Retry.BufferMaxBytes)
+	v.SetDefault("retry.rules", defaultConfig.Retry.Rules)
+	v.SetDefault("hedging.enabled", defaultConfig.Hedging.Enabled)
+	v.SetDefault("hedging.min_delay_ms", defaultConfig.Hedging.MinDelayMs)
+	v.SetDefault("hedging.rules", defaultConfig.Hedging.Rules)
+	v.SetDefault("session_consistency.enabled", defaultConfig.SessionConsistency.Enabled)
+	v.SetDefault("session_consistency.key_header", defaultConfig.SessionConsistency.KeyHeader)
+	v.SetDefault("session_consistency.ttl_seconds", defaultConfig.SessionConsistency.TTLSeconds)
+	v.SetDefault("session_consistency.poll_interval_ms", defaultConfig.SessionConsistency.PollIntervalMs)
+	v.SetDefault("session_consistency.rewrite_head", defaultConfig.SessionConsistency.RewriteHead)
+	v.SetDefault("block_pinning.enabled", defaultConfig.BlockPinning.Enabled)
+	v.SetDefault("block_pinning.header", defaultConfig.BlockPinning.Header)
+	v.SetDefault("chain_verification.enabled", defaultConfig.ChainVerification.Enabled)
+	v.SetDefault("chain_verification.expected_chain_id", defaultConfig.ChainVerification.ExpectedChainID)
+	v.SetDefault("chain_verification.retry_expected_chain_id", defaultConfig.ChainVerification.RetryExpectedChainID)
+	v.SetDefault("chain_verification.interval_seconds", defaultConfig.ChainVerification.IntervalSeconds)
+	v.SetDefault("circuit_breaker.enabled", defaultConfig.CircuitBreaker.Enabled)
+	v.SetDefault("circuit_breaker.window_seconds", defaultConfig.CircuitBreaker.WindowSeconds)
+	v.SetDefault("circuit_breaker.min_requests", defaultConfig.CircuitBreaker.MinRequests)
+	v.SetDefault("circuit_breaker.error_rate", defaultConfig.CircuitBreaker.ErrorRate)
+	v.SetDefault("circuit_breaker.slow_ms", defaultConfig.CircuitBreaker.SlowMs)
+	v.SetDefault("circuit_breaker.slow_rate", defaultConfig.CircuitBreaker.SlowRate)
+	v.SetDefault("circuit_breaker.open_seconds", defaultConfig.CircuitBreaker.OpenSeconds)
+	v.SetDefault("circuit_breaker.half_open_requests", defaultConfig.CircuitBreaker.HalfOpenRequests)
+	v.SetDefault("metrics.enabled", defaultConfig.Metrics.Enabled)
+	v.SetDefault("metrics.pprof", defaultConfig.Metrics.Pprof)
+	v.SetDefault("metrics.host", defaultConfig.Metrics.Host)
+	v.SetDefault("admin.enabled", defaultConfig.Admin.Enabled)
+	v.SetDefault("admin.host", defaultConfig.Admin.Host)
+	v.SetDefault("cors.enabled", defaultConfig.CORS.Enabled)
+	v.SetDefault("gzip.enabled", defaultConfig.GZIP.Enabled)
+	v.SetDefault("normalize_path.enabled", defaultConfig.NormalizePath.Enabled)
+	v.SetDefault("gc.optimize_memory_store", defaultConfig.GC.OptimizeMemoryStore)
+	v.SetDefault("gc.percent", defaultConfig.GC.Percent)
+
+}
+
+// readConfigFile reads and validates the configuration file, on top of the
+// defaults and environment variables set up by setupViper.
+func readConfigFile() (*ConfigFile, error) {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return nil, err
+		}
+	}
 
 	// Unmarshal the configuration into the Config struct
 	var configFile ConfigFile
-	err := viper.Unmarshal(&configFile)
+	decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		fallbackHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	))
+	if err := viper.Unmarshal(&configFile, decodeHook); err != nil {
+		return nil, err
+	}
+
+	v, err := newValidator(viper.ConfigFileUsed())
 	if err != nil {
-		log.Logger.Fatal().Err(err).Msg("unable to decode configuration")
+		return nil, err
 	}
-	viper.SafeWriteConfig()
-	viper.WatchConfig()
+	if errs := v.validate(&configFile); len(errs) > 0 {
+		return nil, errs
+	}
+
+	return &configFile, nil
+}
 
-	return &configFile
+// Check loads and validates the configuration without starting anything
+// nor writing any file. It returns the path of the file used, if any.
+func Check(options Options) (string, error) {
+	if err := setupViper(options); err != nil {
+		return options.File, err
+	}
+	_, err := readConfigFile()
+	return viper.ConfigFileUsed(), err
+}
+
+// DefaultConfigYAML returns the default configuration as a YAML file.
+func DefaultConfigYAML() ([]byte, error) {
+	v := viper.New()
+	setDefaults(v)
+	return yaml.Marshal(v.AllSettings())
+}
+
+// OnConfigFileChange calls run every time the configuration file changes.
+func OnConfigFileChange(run func()) {
+	viper.OnConfigChange(func(fsnotify.Event) {
+		run()
+	})
+}
+
+// fallbackHookFunc decodes a fallback written as a host alone, and
+// tezos_host_retry written as a single host or a comma separated list, like
+// it was before fallbacks had weights.
+func fallbackHookFunc() mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() != reflect.String {
+			return data, nil
+		}
+
+		switch to {
+		case reflect.TypeOf(Fallback{}):
+			return map[string]interface{}{"host": data}, nil
+		case reflect.TypeOf([]Fallback{}):
+			fallbacks := []interface{}{}
+			for _, host := range strings.Split(data.(string), ",") {
+				if host = strings.TrimSpace(host); host != "" {
+					fallbacks = append(fallbacks, map[string]interface{}{"host": host})
+				}
+			}
+			return fallbacks, nil
+		}
+		return data, nil
+	}
 }
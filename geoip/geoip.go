@@ -0,0 +1,163 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/rs/zerolog"
+)
+
+type Record struct {
+	Country string
+	ASN     uint
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+type asnRecord struct {
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// Locator resolves IPs using local MaxMind databases. Databases are read in
+// memory and swapped atomically when their file changes on disk.
+type Locator struct {
+	countryPath string
+	asnPath     string
+	country     atomic.Pointer[maxminddb.Reader]
+	asn         atomic.Pointer[maxminddb.Reader]
+	watcher     *fsnotify.Watcher
+	logger      zerolog.Logger
+}
+
+// Open loads the country database and, when asnPath is set, the ASN one.
+func Open(countryPath, asnPath string, logger zerolog.Logger) (*Locator, error) {
+	l := &Locator{
+		countryPath: countryPath,
+		asnPath:     asnPath,
+		logger:      logger,
+	}
+
+	if err := l.load(countryPath, &l.country); err != nil {
+		return nil, err
+	}
+	if asnPath != "" {
+		if err := l.load(asnPath, &l.asn); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func (l *Locator) Lookup(ip net.IP) Record {
+	var record Record
+	if ip == nil {
+		return record
+	}
+
+	if reader := l.country.Load(); reader != nil {
+		var country countryRecord
+		if err := reader.Lookup(ip, &country); err == nil {
+			record.Country = country.Country.ISOCode
+		}
+	}
+
+	if reader := l.asn.Load(); reader != nil {
+		var asn asnRecord
+		if err := reader.Lookup(ip, &asn); err == nil {
+			record.ASN = asn.AutonomousSystemNumber
+		}
+	}
+
+	return record
+}
+
+// Watch reloads the databases whenever their files are replaced or written.
+func (l *Locator) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	paths := map[string]*atomic.Pointer[maxminddb.Reader]{
+		filepath.Clean(l.countryPath): &l.country,
+	}
+	if l.asnPath != "" {
+		paths[filepath.Clean(l.asnPath)] = &l.asn
+	}
+
+	// Watch the directories, files are usually replaced rather than edited
+	for path := range paths {
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	l.watcher = watcher
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				reader, has := paths[filepath.Clean(event.Name)]
+				if !has {
+					continue
+				}
+
+				// Let the writer finish before reading the new file
+				time.Sleep(time.Second)
+				if err := l.load(event.Name, reader); err != nil {
+					l.logger.Error().Err(err).Str("path", event.Name).Msg("unable to reload geoip database")
+					continue
+				}
+				l.logger.Info().Str("path", event.Name).Msg("geoip database reloaded")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				l.logger.Error().Err(err).Msg("geoip watcher error")
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the database files. Lookups keep working with the
+// databases loaded so far.
+func (l *Locator) Close() error {
+	if l.watcher == nil {
+		return nil
+	}
+	return l.watcher.Close()
+}
+
+func (l *Locator) load(path string, target *atomic.Pointer[maxminddb.Reader]) error {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	reader, err := maxminddb.FromBytes(buffer)
+	if err != nil {
+		return err
+	}
+
+	target.Store(reader)
+	return nil
+}
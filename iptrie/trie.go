@@ -0,0 +1,93 @@
+package iptrie
+
+import "net"
+
+// Trie is a binary prefix tree of IP ranges. IPv4 and IPv6 ranges are kept
+// in separate trees, so a lookup costs at most 32 or 128 steps regardless of
+// how many ranges are stored.
+type Trie struct {
+	v4 *node
+	v6 *node
+}
+
+type node struct {
+	children [2]*node
+	terminal bool
+}
+
+func New() *Trie {
+	return &Trie{v4: &node{}, v6: &node{}}
+}
+
+// Insert adds a range to the trie.
+func (t *Trie) Insert(ipNet *net.IPNet) {
+	ip, root := t.root(ipNet.IP)
+	if ip == nil {
+		return
+	}
+
+	ones, bits := ipNet.Mask.Size()
+	if len(ip) == net.IPv4len && bits == 8*net.IPv6len {
+		// IPv4-mapped IPv6 range
+		if ones < 96 {
+			return
+		}
+		ones -= 96
+	}
+	n := root
+	for i := 0; i < ones; i++ {
+		if n.terminal {
+			// A wider range already covers this one
+			return
+		}
+		b := bit(ip, i)
+		if n.children[b] == nil {
+			n.children[b] = &node{}
+		}
+		n = n.children[b]
+	}
+	n.terminal = true
+	n.children = [2]*node{}
+}
+
+// Contains reports whether ip belongs to any range of the trie.
+func (t *Trie) Contains(ip net.IP) bool {
+	if t == nil {
+		return false
+	}
+
+	ip, n := t.root(ip)
+	if ip == nil {
+		return false
+	}
+
+	for i := 0; i < len(ip)*8; i++ {
+		if n.terminal {
+			return true
+		}
+		n = n.children[bit(ip, i)]
+		if n == nil {
+			return false
+		}
+	}
+	return n.terminal
+}
+
+// ContainsString parses ip and reports whether it belongs to the trie.
+func (t *Trie) ContainsString(ip string) bool {
+	return t.Contains(net.ParseIP(ip))
+}
+
+func (t *Trie) root(ip net.IP) (net.IP, *node) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, t.v4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return ip16, t.v6
+	}
+	return nil, nil
+}
+
+func bit(ip net.IP, i int) byte {
+	return (ip[i/8] >> (7 - uint(i%8))) & 1
+}
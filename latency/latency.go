@@ -0,0 +1,58 @@
+package latency
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracker keeps the last latencies observed to compute one of their
+// percentiles. The percentile is computed again once a tenth of the samples
+// were replaced.
+type Tracker struct {
+	mutex      sync.Mutex
+	samples    []time.Duration
+	next       int
+	count      int
+	percentile float64
+	value      time.Duration
+	stale      int
+}
+
+// NewTracker keeps size latencies to compute a percentile, from 0 to 100.
+func NewTracker(size int, percentile float64) *Tracker {
+	return &Tracker{
+		samples:    make([]time.Duration, size),
+		percentile: percentile,
+	}
+}
+
+// Observe records a latency, replacing the oldest one.
+func (t *Tracker) Observe(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.samples[t.next] = latency
+	t.next = (t.next + 1) % len(t.samples)
+	t.count = min(t.count+1, len(t.samples))
+	t.stale++
+}
+
+// Percentile returns the percentile of the latencies observed, and false
+// while less than minSamples were.
+func (t *Tracker) Percentile(minSamples int) (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.count == 0 || t.count < minSamples {
+		return 0, false
+	}
+
+	if t.value == 0 || t.stale >= max(len(t.samples)/10, 1) {
+		sorted := make([]time.Duration, t.count)
+		copy(sorted, t.samples[:t.count])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(float64(t.count-1) * t.percentile / 100)
+		t.value = sorted[i]
+		t.stale = 0
+	}
+	return t.value, true
+}
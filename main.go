@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
@@ -14,39 +15,66 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/marigold-dev/tzproxy/config"
 	"github.com/marigold-dev/tzproxy/middlewares"
+	"github.com/pires/go-proxyproto"
 	"github.com/ziflex/lecho/v3"
 )
 
 func main() {
-	config := config.NewConfig()
+	os.Exit(runCommand(os.Args[1:]))
+}
+
+func serve(options config.Options) {
+	config := config.NewConfig(options)
 
 	debug.SetGCPercent(config.ConfigFile.GC.Percent)
 
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
-
-	// Middlewares
 	e.Logger = lecho.From(config.Logger)
-	e.Use(middleware.Recover())
-	e.Use(middleware.RequestLoggerWithConfig(*config.RequestLoggerConfig))
-	e.Use(middlewares.CORS(config))
-	e.Use(middlewares.RateLimit(config))
-	e.Use(middlewares.DenyIPs(config))
-	e.Use(middlewares.AllowRoutes(config))
-	e.Use(middlewares.DenyRoutes(config))
-	e.Use(middlewares.Cache(config))
-	e.Use(middlewares.Gzip(config))
-	e.Use(middlewares.Retry(config))
-	e.Use(middleware.ProxyWithConfig(*config.ProxyConfig))
+
+	// Middlewares are built from the current configuration and swapped on reload
+	proxy := newReloadableHandler(config, buildMiddlewares)
+	e.IPExtractor = proxy.ExtractIP
+	e.Use(proxy.Middleware)
+	watchReload(proxy)
 
 	// Start metrics server
 	startMetricsServer(config)
 
+	// Start admin server
+	startAdminServer(config, proxy)
+
 	// Start proxy
 	startProxyWithGracefulShutdown(e, config)
 }
 
+func buildMiddlewares(config *config.Config) []echo.MiddlewareFunc {
+	return []echo.MiddlewareFunc{
+		middleware.Recover(),
+		middleware.RequestLoggerWithConfig(*config.RequestLoggerConfig),
+		middlewares.NormalizePath(config),
+		middlewares.CORS(config),
+		middlewares.AutoBan(config),
+		middlewares.RateLimit(config),
+		middlewares.DenyIPs(config),
+		middlewares.AllowIPs(config),
+		middlewares.GeoIP(config),
+		middlewares.AllowRoutes(config),
+		middlewares.DenyRoutes(config),
+		middlewares.QueryPolicies(config),
+		middlewares.BodyLimit(config),
+		middlewares.BlockPinning(config),
+		middlewares.SessionConsistency(config),
+		middlewares.Cache(config),
+		middlewares.ConcurrencyLimit(config),
+		middlewares.Gzip(config),
+		middlewares.Retry(config),
+		middlewares.Hedge(config),
+		middleware.ProxyWithConfig(*config.ProxyConfig),
+	}
+}
+
 func startMetricsServer(config *config.Config) {
 	if config.ConfigFile.Metrics.Enabled {
 		go func() {
@@ -73,6 +101,10 @@ func startMetricsServer(config *config.Config) {
 }
 
 func startProxyWithGracefulShutdown(e *echo.Echo, config *config.Config) {
+	if config.ConfigFile.ProxyProtocol.Enabled {
+		e.Listener = proxyProtocolListener(config)
+	}
+
 	go func() {
 		if err := e.Start(config.ConfigFile.Host); err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("Shutting down the server")
@@ -91,3 +123,20 @@ func startProxyWithGracefulShutdown(e *echo.Echo, config *config.Config) {
 		e.Logger.Fatal(err)
 	}
 }
+
+// proxyProtocolListener accepts PROXY protocol v1/v2 headers so the client
+// address survives L4 load balancers. Only the trusted proxies can send
+// the header, it is ignored when it comes from anybody else.
+func proxyProtocolListener(config *config.Config) net.Listener {
+	l, err := net.Listen("tcp", config.ConfigFile.Host)
+	if err != nil {
+		config.Logger.Fatal().Err(err).Msg("unable to listen")
+	}
+
+	policy, err := proxyproto.LaxWhiteListPolicy(config.ConfigFile.TrustedProxies)
+	if err != nil {
+		config.Logger.Fatal().Err(err).Msg("unable to parse trusted proxies")
+	}
+
+	return &proxyproto.Listener{Listener: l, Policy: policy}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered in the default registry, which is the one served
+// by the metrics server.
+var (
+	RequestsByCountry = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "requests_by_country_total",
+		Help:      "Number of requests by client country.",
+	}, []string{"country"})
+
+	ResponsesTooLarge = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "upstream_responses_too_large_total",
+		Help:      "Number of upstream responses aborted for going past their size limit.",
+	})
+
+	UpstreamTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "upstream_timeouts_total",
+		Help:      "Number of upstream requests that timed out, by phase (connect, header or total).",
+	}, []string{"phase"})
+
+	RPCErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "rpc_errors_total",
+		Help:      "Number of Tezos errors in the node responses, by kind and id without the protocol.",
+	}, []string{"kind", "id"})
+
+	Retries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "retries_total",
+		Help:      "Number of requests eligible for a retry, by outcome (retried, budget_exhausted or no_target).",
+	}, []string{"outcome"})
+
+	HedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "hedged_requests_total",
+		Help:      "Number of requests sent to a second target, by the request that answered first (first, hedge or none).",
+	}, []string{"winner"})
+
+	HeadLevel = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tzproxy",
+		Name:      "head_level",
+		Help:      "Level of the last head known on each target, polled or served.",
+	}, []string{"target"})
+
+	WrongChain = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tzproxy",
+		Name:      "wrong_chain",
+		Help:      "Whether each target was found on another chain than the expected one: 1 if it was, 0 otherwise.",
+	}, []string{"target"})
+
+	CircuitBreakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "tzproxy",
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker of each target: 0 closed, 1 half-open, 2 open.",
+	}, []string{"target"})
+
+	CircuitBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "tzproxy",
+		Name:      "circuit_breaker_transitions_total",
+		Help:      "Number of circuit breaker state changes, by target and new state.",
+	}, []string{"target", "state"})
+)
@@ -0,0 +1,26 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+func AllowIPs(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.AllowIPs.Enabled {
+				return next(c)
+			}
+
+			if !config.AllowIPsTable.ContainsString(c.RealIP()) {
+				return c.JSON(http.StatusForbidden, echo.Map{
+					"success": false,
+					"message": "Your IP is not allowed",
+				})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/bans"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/tezos"
+)
+
+func AutoBan(config *config.Config) echo.MiddlewareFunc {
+	window := time.Duration(config.ConfigFile.AutoBan.WindowSeconds) * time.Second
+	duration := time.Duration(config.ConfigFile.AutoBan.BanSeconds) * time.Second
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.AutoBan.Enabled {
+				return next(c)
+			}
+
+			ctx := c.Request().Context()
+			ip := c.RealIP()
+			if config.AllowIPsTable.ContainsString(ip) {
+				return next(c)
+			}
+
+			ban, banErr := config.Bans.Get(ctx, ip)
+			if banErr != nil {
+				config.Logger.Error().Err(banErr).Str("ip", ip).Msg("unable to check ban")
+			} else if ban != nil {
+				retryAfter := int64(time.Until(ban.Until).Seconds()) + 1
+				c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+				return c.JSON(http.StatusForbidden, echo.Map{
+					"success": false,
+					"message": "Your IP is temporarily banned",
+				})
+			}
+
+			// The Tezos errors of a rejected injection are read from its body
+			res := c.Response()
+			var capture *errorCapture
+			if isInjection(c.Request()) {
+				capture = &errorCapture{ResponseWriter: res.Writer}
+				res.Writer = capture
+			}
+			err = next(c)
+			if capture != nil {
+				res.Writer = capture.ResponseWriter
+			}
+
+			status := res.Status
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+
+			reason, max := offense(config, c, status, capture)
+			if max <= 0 {
+				return err
+			}
+
+			count, hitErr := config.Bans.Hit(ctx, ip, reason, window)
+			if hitErr != nil {
+				config.Logger.Error().Err(hitErr).Str("ip", ip).Msg("unable to record offense")
+				return err
+			}
+
+			if count >= int64(max) {
+				banErr = config.Bans.Ban(ctx, bans.Ban{
+					IP:     ip,
+					Reason: reason,
+					Until:  time.Now().Add(duration),
+				})
+				if banErr != nil {
+					config.Logger.Error().Err(banErr).Str("ip", ip).Msg("unable to ban")
+				} else {
+					config.Logger.Warn().
+						Str("ip", ip).
+						Str("reason", reason).
+						Int64("offenses", count).
+						Dur("duration", duration).
+						Msg("ip banned")
+				}
+			}
+
+			return err
+		}
+	}
+}
+
+// offense classifies a response and returns the threshold that applies to
+// it, or 0 when the response doesn't count against the client. Only the
+// 403 and 429 responses of the route and rate limit checks, which set the
+// offense context key, and the injections rejected with a permanent or
+// branch Tezos error count: a node refusing a request, failing or saturated
+// isn't the fault of the client.
+func offense(config *config.Config, c echo.Context, status int, capture *errorCapture) (string, int) {
+	reason, _ := c.Get("offense").(string)
+	switch {
+	case reason == bans.ReasonForbidden:
+		return bans.ReasonForbidden, config.ConfigFile.AutoBan.MaxForbidden
+	case reason == bans.ReasonRateLimited:
+		return bans.ReasonRateLimited, config.ConfigFile.AutoBan.MaxRateLimited
+	case capture != nil && status >= http.StatusBadRequest && hasClientError(capture.errors()):
+		return bans.ReasonBadInjection, config.ConfigFile.AutoBan.MaxBadInjections
+	}
+
+	return "", 0
+}
+
+func isInjection(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/injection/")
+}
+
+// hasClientError reports whether one of the errors is caused by the
+// request: a permanent error, or a branch error on an invalid operation.
+func hasClientError(errs []tezos.Error) bool {
+	for _, e := range errs {
+		if e.Kind == tezos.KindPermanent || e.Kind == tezos.KindBranch {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCapture keeps the start of an error response while it is written
+// through, so that its Tezos errors can be read.
+type errorCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (e *errorCapture) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorCapture) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	if e.status >= http.StatusBadRequest {
+		if room := tezos.MaxErrorBytes - e.body.Len(); room > 0 {
+			e.body.Write(b[:min(len(b), room)])
+		}
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *errorCapture) Flush() {
+	http.NewResponseController(e.ResponseWriter).Flush()
+}
+
+func (e *errorCapture) Unwrap() http.ResponseWriter {
+	return e.ResponseWriter
+}
+
+// errors returns the Tezos errors of the captured body, which the gzip
+// middleware may have compressed.
+func (e *errorCapture) errors() []tezos.Error {
+	body := e.body.Bytes()
+	if e.Header().Get(echo.HeaderContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil
+		}
+		defer gz.Close()
+		body, err = io.ReadAll(io.LimitReader(gz, tezos.MaxErrorBytes))
+		if err != nil {
+			return nil
+		}
+	}
+	return tezos.ParseErrors(body)
+}
@@ -0,0 +1,109 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+// BodyLimit rejects request bodies larger than the limit of their route
+// with a 413 and, for JSON routes, malformed or too deeply nested bodies with
+// a 400, before they reach the node. Limited bodies are read in memory, so
+// the next middlewares never buffer more than the limit.
+func BodyLimit(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			r := c.Request()
+			if !config.ConfigFile.BodyLimits.Enabled || r.Body == nil || r.Body == http.NoBody {
+				return next(c)
+			}
+
+			maxBytes, isJSON := config.BodyLimit(r.Method, r.URL.Path)
+			if maxBytes == 0 {
+				return next(c)
+			}
+			if r.ContentLength > maxBytes {
+				return bodyTooLarge(c)
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"success": false,
+					"message": "Unable to read the request body",
+				})
+			}
+			if int64(len(body)) > maxBytes {
+				return bodyTooLarge(c)
+			}
+
+			if isJSON && len(body) > 0 && !isBinary(r.Header.Get("Content-Type")) {
+				if !json.Valid(body) {
+					return c.JSON(http.StatusBadRequest, echo.Map{
+						"success": false,
+						"message": "Invalid JSON body",
+					})
+				}
+				maxDepth := config.ConfigFile.BodyLimits.MaxJSONDepth
+				if maxDepth > 0 && jsonDepth(body) > maxDepth {
+					return c.JSON(http.StatusBadRequest, echo.Map{
+						"success": false,
+						"message": "JSON body is nested too deeply",
+					})
+				}
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+
+			return next(c)
+		}
+	}
+}
+
+func bodyTooLarge(c echo.Context) error {
+	return c.JSON(http.StatusRequestEntityTooLarge, echo.Map{
+		"success": false,
+		"message": "Request body is too large",
+	})
+}
+
+// isBinary reports whether the body uses one of the binary encodings of the
+// node instead of JSON.
+func isBinary(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/octet-stream") ||
+		strings.HasPrefix(contentType, "application/bson")
+}
+
+// jsonDepth returns the maximum nesting depth of a JSON document.
+func jsonDepth(data []byte) int {
+	depth, max := 0, 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			if b == '\\' {
+				escaped = true
+			} else if b == '"' {
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return max
+}
@@ -1,60 +1,185 @@
 package middlewares
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 
-	echocache "github.com/fraidev/go-echo-cache"
 	"github.com/labstack/echo/v4"
 	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/tezos"
 )
 
+// Cache serves the successful responses of the cacheable requests from the
+// store. A response is captured while it is sent to the client, and is no
+// longer captured once it goes past the buffer limit, so that a large
+// response is streamed without being held in memory.
 func Cache(config *config.Config) echo.MiddlewareFunc {
-	return echocache.New(&echocache.Config{
-		TTL: config.CacheTTL,
-		Cache: func(r *http.Request) bool {
-			if !config.ConfigFile.Cache.Enabled ||
-				r.Method != http.MethodGet ||
-				strings.Contains(r.URL.Path, "mempool") ||
-				strings.Contains(r.URL.Path, "monitor") {
-				return false
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if !config.IsCacheable(r.Method, r.URL.Path) {
+				return next(c)
 			}
 
-			regexRoutesByMethod, has := config.CacheDisabledRoutesRegex[r.Method]
-			if !has {
-				return true
+			ctx := r.Context()
+			key := cacheKey(r)
+			res := c.Response()
+			if value, err := config.Store.Get(ctx, key); err == nil && len(value) > 0 {
+				var cached cachedResponse
+				if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&cached); err == nil {
+					return cached.write(res)
+				}
 			}
 
-			for _, regex := range regexRoutesByMethod {
-				if regex.MatchString(r.URL.Path) {
-					return false
-				}
+			capture := newCacheCapture(res.Writer, config.BufferLimit())
+			res.Writer = capture
+			err := next(c)
+			res.Writer = capture.ResponseWriter
+			if err != nil || !capture.complete() {
+				return err
 			}
 
-			return true
-		},
-		GetKey: func(r *http.Request) []byte {
-			base := r.Method + "|" + r.URL.Path + "|" + r.URL.Query().Encode()
+			var value bytes.Buffer
+			cached := cachedResponse{Status: capture.status, Header: capture.header, Body: capture.body.Bytes()}
+			if err := gob.NewEncoder(&value).Encode(&cached); err != nil {
+				return nil
+			}
+			ttl := int(config.CacheTTL.Seconds())
+			if err := config.Store.Set(ctx, key, value.Bytes(), ttl); err != nil {
+				config.Logger.Debug().Err(err).Str("key", string(key)).Msg("unable to cache response")
+			}
+			return nil
+		}
+	}
+}
 
-			gzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+func cacheKey(r *http.Request) []byte {
+	// Equivalent block references share their responses
+	path := r.URL.Path
+	if block, ok := tezos.ParseBlockPath(path); ok {
+		block.Block = block.Block.Canonical()
+		path = block.String()
+	}
+	base := r.Method + "|" + path + "|" + r.URL.Query().Encode()
 
-			acceptHeader := r.Header.Get("Accept")
-			if mediaIsUsed(acceptHeader, "application/bson") {
-				base += "|bson"
-			} else if mediaIsUsed(acceptHeader, "application/octet-stream") {
-				base += "|octet"
-			} else {
-				base += "|json"
-			}
+	gzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
 
-			if gzip {
-				base += "|gzip"
+	acceptHeader := r.Header.Get("Accept")
+	if mediaIsUsed(acceptHeader, "application/bson") {
+		base += "|bson"
+	} else if mediaIsUsed(acceptHeader, "application/octet-stream") {
+		base += "|octet"
+	} else {
+		base += "|json"
+	}
+
+	if gzip {
+		base += "|gzip"
+	}
+
+	return []byte(base)
+}
+
+// cachedResponse is a response as it is kept in the store.
+type cachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func (cached *cachedResponse) write(res *echo.Response) error {
+	header := res.Header()
+	for name, values := range cached.Header {
+		header[name] = append(header[name], values...)
+	}
+	res.WriteHeader(cached.Status)
+	_, err := res.Write(cached.Body)
+	return err
+}
+
+// cacheCapture writes a response through while keeping a copy of it, until
+// it is known to be larger than the limit or not to be cached.
+type cacheCapture struct {
+	http.ResponseWriter
+	limit int64
+	// own counts the header values set before the response by the outer
+	// middlewares, which are not part of the cached response.
+	own     map[string]int
+	status  int
+	header  http.Header
+	body    bytes.Buffer
+	dropped bool
+}
+
+func newCacheCapture(w http.ResponseWriter, limit int64) *cacheCapture {
+	own := make(map[string]int, len(w.Header()))
+	for name, values := range w.Header() {
+		own[name] = len(values)
+	}
+	return &cacheCapture{ResponseWriter: w, limit: limit, own: own}
+}
+
+func (w *cacheCapture) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = make(http.Header)
+		for name, values := range w.Header() {
+			if len(values) > w.own[name] {
+				w.header[name] = values[w.own[name]:]
 			}
+		}
+		if status != http.StatusOK {
+			w.drop()
+		} else if length, err := strconv.ParseInt(w.Header().Get(echo.HeaderContentLength), 10, 64); err == nil && w.over(length) {
+			w.drop()
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheCapture) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.dropped {
+		if w.over(int64(w.body.Len() + len(b))) {
+			w.drop()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.drop()
+	}
+	return n, err
+}
+
+func (w *cacheCapture) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *cacheCapture) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *cacheCapture) over(size int64) bool {
+	return w.limit > 0 && size > w.limit
+}
+
+// drop stops the capture and releases what was kept.
+func (w *cacheCapture) drop() {
+	w.dropped = true
+	w.body = bytes.Buffer{}
+}
 
-			return []byte(base)
-		},
-	}, config.Store)
+// complete reports whether the whole response was captured.
+func (w *cacheCapture) complete() bool {
+	return w.status != 0 && !w.dropped
 }
 
 func mediaIsUsed(acceptHeader, media string) bool {
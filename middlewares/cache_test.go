@@ -0,0 +1,107 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/rs/zerolog"
+)
+
+// mapStore is a store keeping its values in a map.
+type mapStore map[string][]byte
+
+func (s mapStore) Get(ctx context.Context, key []byte) ([]byte, error) {
+	return s[string(key)], nil
+}
+
+func (s mapStore) Set(ctx context.Context, key []byte, value []byte, ttl int) error {
+	s[string(key)] = value
+	return nil
+}
+
+func TestCacheLimit(t *testing.T) {
+	const limit = 1024
+	const chunk = 256
+
+	tests := []struct {
+		name          string
+		size          int
+		contentLength bool
+		status        int
+		cached        bool
+	}{
+		{name: "under the limit", size: limit, status: http.StatusOK, cached: true},
+		{name: "over the limit", size: 4 * limit, status: http.StatusOK},
+		{name: "announced over the limit", size: 4 * limit, contentLength: true, status: http.StatusOK},
+		{name: "error", size: chunk, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := mapStore{}
+			cfg := &config.Config{
+				ConfigFile: &config.ConfigFile{
+					Cache:          config.Cache{Enabled: true},
+					ResponseLimits: config.ResponseLimits{Enabled: true, BufferMaxBytes: limit},
+				},
+				Store:    store,
+				CacheTTL: time.Minute,
+				Logger:   zerolog.Nop(),
+			}
+			body := bytes.Repeat([]byte("x"), tt.size)
+
+			calls := 0
+			handler := Cache(cfg)(func(c echo.Context) error {
+				calls++
+				res := c.Response()
+				capture, _ := res.Writer.(*cacheCapture)
+				if tt.contentLength {
+					res.Header().Set(echo.HeaderContentLength, strconv.Itoa(tt.size))
+				}
+				res.WriteHeader(tt.status)
+				for i := 0; i < len(body); i += chunk {
+					if _, err := res.Write(body[i : i+chunk]); err != nil {
+						return err
+					}
+					if capture != nil && capture.body.Len() > limit {
+						t.Fatalf("%d bytes held, over the limit", capture.body.Len())
+					}
+					if tt.contentLength && capture != nil && capture.body.Len() > 0 {
+						t.Fatal("a response announced over the limit is captured")
+					}
+				}
+				return nil
+			})
+
+			e := echo.New()
+			for i := 0; i < 2; i++ {
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/chains/main/blocks/head/context/constants", nil)
+				if err := handler(e.NewContext(req, rec)); err != nil {
+					t.Fatal(err)
+				}
+				if rec.Code != tt.status || !bytes.Equal(rec.Body.Bytes(), body) {
+					t.Fatalf("request %d: got %d with %d bytes, want %d with %d bytes", i, rec.Code, rec.Body.Len(), tt.status, len(body))
+				}
+			}
+
+			if cached := len(store) > 0; cached != tt.cached {
+				t.Errorf("cached = %v, want %v", cached, tt.cached)
+			}
+			wantCalls := 2
+			if tt.cached {
+				wantCalls = 1
+			}
+			if calls != wantCalls {
+				t.Errorf("handler called %d times, want %d", calls, wantCalls)
+			}
+		})
+	}
+}
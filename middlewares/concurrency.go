@@ -0,0 +1,45 @@
+package middlewares
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+func ConcurrencyLimit(config *config.Config) echo.MiddlewareFunc {
+	queueTimeout := time.Duration(config.ConfigFile.Concurrency.QueueTimeoutMs) * time.Millisecond
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.Concurrency.Enabled {
+				return next(c)
+			}
+
+			key := clientKey(c, config.ConfigFile.Concurrency.KeyHeader)
+			err = config.ClientConcurrency.Acquire(c.Request().Context(), key, queueTimeout)
+			if err != nil {
+				return c.JSON(http.StatusTooManyRequests, echo.Map{
+					"success": false,
+					"message": "Too Many Concurrent Requests on " + c.Request().URL.String(),
+				})
+			}
+			defer config.ClientConcurrency.Release(key)
+
+			return next(c)
+		}
+	}
+}
+
+// clientKey identifies the client by the given header when it is set,
+// falling back to its IP address.
+func clientKey(c echo.Context, header string) string {
+	if header != "" {
+		if key := c.Request().Header.Get(header); key != "" {
+			return "key:" + key
+		}
+	}
+
+	return "ip:" + c.RealIP()
+}
@@ -14,5 +14,7 @@ func CORS(config *config.Config) echo.MiddlewareFunc {
 		AllowHeaders: []string{"*"},
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{"*"},
+		// Browsers only let the scripts read the listed headers
+		ExposeHeaders: []string{headerBlockHash, headerLevel},
 	})
 }
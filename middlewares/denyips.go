@@ -14,8 +14,7 @@ func DenyIPs(config *config.Config) echo.MiddlewareFunc {
 				return next(c)
 			}
 
-			value, has := config.DenyIPsTable[c.RealIP()]
-			if value && has {
+			if config.DenyIPsTable.ContainsString(c.RealIP()) {
 				return c.JSON(http.StatusForbidden, echo.Map{
 					"success": false,
 					"message": "Your IP is blocked",
@@ -0,0 +1,93 @@
+package middlewares
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/ulule/limiter/v3"
+)
+
+func GeoIP(config *config.Config) echo.MiddlewareFunc {
+	geo := config.ConfigFile.GeoIP
+	allowCountries := toSet(geo.AllowCountries)
+	denyCountries := toSet(geo.DenyCountries)
+	rateLimitedCountries := toSet(geo.RateLimitCountries)
+	allowASNs := make(map[uint]bool)
+	for _, asn := range geo.AllowASNs {
+		allowASNs[asn] = true
+	}
+	denyASNs := make(map[uint]bool)
+	for _, asn := range geo.DenyASNs {
+		denyASNs[asn] = true
+	}
+
+	countryRateLimiter := limiter.New(config.RateLimitStore, limiter.Rate{
+		Period: config.Rate.Period,
+		Limit:  int64(geo.RateLimitMax),
+	})
+	policy := fmt.Sprintf("%d;w=%d", geo.RateLimitMax, int64(config.Rate.Period.Seconds()))
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.GeoIP.Enabled {
+				return next(c)
+			}
+
+			ip := c.RealIP()
+			record := config.GeoIP.Lookup(net.ParseIP(ip))
+			c.Set("country", record.Country)
+
+			country := record.Country
+			if country == "" {
+				country = "unknown"
+			}
+			metrics.RequestsByCountry.WithLabelValues(country).Inc()
+
+			if (len(allowCountries) > 0 && !allowCountries[record.Country]) ||
+				denyCountries[record.Country] ||
+				(len(allowASNs) > 0 && !allowASNs[record.ASN]) ||
+				denyASNs[record.ASN] {
+				return c.JSON(http.StatusForbidden, echo.Map{
+					"success": false,
+					"message": "Your location is not allowed",
+				})
+			}
+
+			if rateLimitedCountries[record.Country] {
+				limiterCtx, err := countryRateLimiter.Get(c.Request().Context(), "geo:"+ip)
+				if err != nil {
+					config.Logger.Error().Err(err).Str("ip", ip).Msg("rate limit store unavailable")
+					if !config.ConfigFile.RateLimit.FailOpen {
+						c.Response().Header().Set("Retry-After", "1")
+						return c.JSON(http.StatusServiceUnavailable, echo.Map{
+							"success": false,
+							"message": "Rate limit temporarily unavailable",
+						})
+					}
+				} else if limiterCtx.Reached {
+					// Set only here, so that they don't replace the headers
+					// of the global rate limit
+					setRateLimitHeaders(c, limiterCtx, policy)
+					return c.JSON(http.StatusTooManyRequests, echo.Map{
+						"success": false,
+						"message": "Too Many Requests on " + c.Request().URL.String(),
+					})
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
@@ -0,0 +1,96 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/transports"
+)
+
+// Hedge proxies the GET requests matched by a hedging rule beside
+// ProxyWithConfig: when the target hasn't answered within the delay of the
+// rule, the request is also sent to another healthy target and the first
+// response is used. Retries go to the target chosen for them and are not
+// hedged.
+func Hedge(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			r := c.Request()
+			if c.Get("retry") != nil || r.Method != http.MethodGet || c.IsWebSocket() {
+				return next(c)
+			}
+			delay, ok := config.HedgeDelay(r.Method, r.URL.Path)
+			if !ok {
+				return next(c)
+			}
+
+			proxyConfig := config.ProxyConfig
+			target := proxyConfig.Balancer.Next(c)
+			if target == nil {
+				// ProxyWithConfig reports that there is no target
+				return next(c)
+			}
+			c.Set(proxyConfig.ContextKey, target)
+			c.Set("_error", nil)
+
+			// The same headers as ProxyWithConfig
+			if r.Header.Get(echo.HeaderXRealIP) == "" || c.Echo().IPExtractor != nil {
+				r.Header.Set(echo.HeaderXRealIP, c.RealIP())
+			}
+			if r.Header.Get(echo.HeaderXForwardedProto) == "" {
+				r.Header.Set(echo.HeaderXForwardedProto, c.Scheme())
+			}
+
+			minLevel, _ := c.Get("min_level").(int64)
+			var alternative *middleware.ProxyTarget
+			proxy := httputil.NewSingleHostReverseProxy(target.URL)
+			proxy.Transport = transports.NewHedgeTransport(proxyConfig.Transport, delay,
+				func() *url.URL {
+					alternative = config.Fallbacks.Alternative([]string{target.URL.Host}, minLevel)
+					if alternative == nil {
+						return nil
+					}
+					return alternative.URL
+				},
+				func(answered *url.URL) {
+					if alternative != nil && answered.Host == alternative.URL.Host {
+						c.Set(proxyConfig.ContextKey, alternative)
+					}
+				},
+				func(latency time.Duration) {
+					config.ObserveLatency(r.Method, r.URL.Path, latency)
+				})
+			proxy.ModifyResponse = proxyConfig.ModifyResponse
+			proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+				// Reported like ProxyWithConfig does
+				if err == context.Canceled || strings.Contains(err.Error(), "operation was canceled") {
+					c.Set("_error", &echo.HTTPError{
+						Code:     middleware.StatusCodeContextCanceled,
+						Message:  fmt.Sprintf("client closed connection: %v", err),
+						Internal: err,
+					})
+					return
+				}
+				c.Set("_error", &echo.HTTPError{
+					Code:     http.StatusBadGateway,
+					Message:  fmt.Sprintf("remote %s unreachable, could not forward: %v", target.URL, err),
+					Internal: err,
+				})
+			}
+			proxy.ServeHTTP(c.Response(), r)
+
+			if err, ok := c.Get("_error").(error); ok {
+				return proxyConfig.ErrorHandler(c, err)
+			}
+			return nil
+		}
+	}
+}
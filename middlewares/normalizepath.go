@@ -0,0 +1,69 @@
+package middlewares
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+var (
+	errEncodedSlash = errors.New("Encoded slashes are not allowed in the path")
+	errInvalidPath  = errors.New("Invalid characters in the path")
+)
+
+// NormalizePath canonicalizes the request in place before any other check,
+// so the routes, the cache key and the upstream request all use the same
+// path.
+func NormalizePath(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.NormalizePath.Enabled {
+				return next(c)
+			}
+
+			r := c.Request()
+			path, err := normalizePath(r.URL)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"success": false,
+					"message": err.Error(),
+				})
+			}
+
+			r.Method = strings.ToUpper(r.Method)
+			r.URL.Path = path
+			r.URL.RawPath = ""
+
+			return next(c)
+		}
+	}
+}
+
+// normalizePath removes duplicate slashes, dot segments and the trailing
+// slash. The case is kept as block hashes and addresses are case sensitive.
+func normalizePath(u *url.URL) (string, error) {
+	escaped := strings.ToLower(u.EscapedPath())
+	if strings.Contains(escaped, "%2f") || strings.Contains(escaped, "%5c") {
+		return "", errEncodedSlash
+	}
+
+	p := u.Path
+	if p == "" {
+		return "/", nil
+	}
+	if p[0] != '/' {
+		return "", errInvalidPath
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] < 0x20 || p[i] == 0x7f || p[i] == '\\' {
+			return "", errInvalidPath
+		}
+	}
+
+	return path.Clean(p), nil
+}
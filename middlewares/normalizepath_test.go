@@ -0,0 +1,104 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/routes"
+	"gopkg.in/yaml.v3"
+)
+
+// FuzzNormalizePath checks that a request reaching the proxy once
+// normalized is never one that deny_routes blocks in its canonical form.
+func FuzzNormalizePath(f *testing.F) {
+	deny := defaultDenyRoutes(f)
+	denied := routes.MustCompile(deny...)
+	cfg := &config.Config{
+		ConfigFile: &config.ConfigFile{
+			NormalizePath: config.NormalizePath{Enabled: true},
+			DenyRoutes:    config.DenyRoutes{Enabled: true, Values: deny},
+		},
+		DenyRoutes: denied,
+	}
+
+	for _, seed := range []struct{ method, target string }{
+		{"GET", "/chains/main/blocks/head/context/contracts"},
+		{"GET", "/chains/main/blocks/head/context/contracts/"},
+		{"GET", "/chains/main/blocks/head%2fcontext/contracts"},
+		{"GET", "/chains/main/blocks/head%2Fcontext%2Fcontracts"},
+		{"GET", "/chains/main/blocks/head%5ccontext/contracts"},
+		{"GET", "/chains/main/blocks/head\\context/contracts"},
+		{"GET", "//chains//main/blocks/head/context//contracts"},
+		{"GET", "/chains/main/blocks/head/header/../context/contracts"},
+		{"GET", "/chains/main/blocks/./head/context/contracts/."},
+		{"GET", "/workers/../workers/prevalidators"},
+		{"GET", "/%77orkers/prevalidators"},
+		{"get", "/chains/main/blocks/head~2/context/raw/bytes"},
+		{"Post", "/injection/block"},
+		{"GET", "/Workers/prevalidators"},
+		{"GET", "/chains/main/blocks/head/helpers/baking_rights?cycle=1"},
+	} {
+		f.Add(seed.method, seed.target)
+	}
+
+	e := echo.New()
+	f.Fuzz(func(t *testing.T, method, target string) {
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			t.Skip()
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Method = method
+		req.URL = u
+		c := e.NewContext(req, httptest.NewRecorder())
+
+		// The canonical form of the path, as a node could understand it
+		canonical := path.Clean("/" + strings.ReplaceAll(u.Path, "\\", "/"))
+		canonicalMethod := strings.ToUpper(method)
+
+		proxied := ""
+		handler := NormalizePath(cfg)(DenyRoutes(cfg)(func(c echo.Context) error {
+			proxied = c.Request().URL.Path
+			return nil
+		}))
+		if err := handler(c); err != nil {
+			t.Fatal(err)
+		}
+		if proxied == "" {
+			return
+		}
+
+		if denied.Match(canonicalMethod, canonical) {
+			t.Errorf("%s %q reached the proxy as %q, but %q is denied", method, target, proxied, canonical)
+		}
+		if proxied != canonical {
+			t.Errorf("%s %q reached the proxy as %q, want %q", method, target, proxied, canonical)
+		}
+	})
+}
+
+// defaultDenyRoutes returns the deny_routes of the default configuration.
+func defaultDenyRoutes(f *testing.F) []string {
+	data, err := config.DefaultConfigYAML()
+	if err != nil {
+		f.Fatal(err)
+	}
+	var defaults struct {
+		DenyRoutes struct {
+			Values []string `yaml:"values"`
+		} `yaml:"deny_routes"`
+	}
+	if err := yaml.Unmarshal(data, &defaults); err != nil {
+		f.Fatal(err)
+	}
+	if len(defaults.DenyRoutes.Values) == 0 {
+		f.Fatal("no default deny_routes")
+	}
+	return defaults.DenyRoutes.Values
+}
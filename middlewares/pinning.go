@@ -0,0 +1,47 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/tezos"
+)
+
+// BlockPinning evaluates the requests relative to the head of the main chain
+// against the block whose hash is in the pinning header, so that a sequence
+// of requests sees the same block while the head moves. When the block was
+// a head polled on the nodes, the request is only sent to the nodes that
+// reached its level.
+func BlockPinning(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !config.ConfigFile.BlockPinning.Enabled {
+				return next(c)
+			}
+			r := c.Request()
+			pin := r.Header.Get(config.ConfigFile.BlockPinning.Header)
+			if pin == "" {
+				return next(c)
+			}
+			block, ok := tezos.ParseBlockPath(r.URL.Path)
+			if !ok || block.Chain != "main" || !block.Block.IsHead() {
+				return next(c)
+			}
+			if !tezos.IsBlockHash(pin) {
+				return c.JSON(http.StatusBadRequest, echo.Map{
+					"success": false,
+					"message": "Invalid block hash in " + config.ConfigFile.BlockPinning.Header,
+				})
+			}
+
+			r.URL.Path = block.WithBase(pin).String()
+			r.URL.RawPath = ""
+			if level, ok := config.Heads.Level(pin); ok {
+				c.Set("min_level", level)
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package middlewares
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+func QueryPolicies(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			if !config.ConfigFile.QueryPolicies.Enabled {
+				return next(c)
+			}
+
+			r := c.Request()
+			query := r.URL.Query()
+			changed, violation := config.ApplyQueryPolicies(r.Method, r.URL.Path, query)
+			if violation != nil {
+				return c.JSON(violation.Status, echo.Map{
+					"success": false,
+					"message": violation.Message,
+				})
+			}
+
+			if changed {
+				r.URL.RawQuery = query.Encode()
+			}
+
+			return next(c)
+		}
+	}
+}
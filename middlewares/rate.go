@@ -1,30 +1,20 @@
 package middlewares
 
 import (
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/bans"
 	"github.com/marigold-dev/tzproxy/config"
 	"github.com/ulule/limiter/v3"
-	"github.com/ulule/limiter/v3/drivers/store/memory"
-	"github.com/ulule/limiter/v3/drivers/store/redis"
 )
 
 func RateLimit(config *config.Config) echo.MiddlewareFunc {
-	var store limiter.Store
-	if config.ConfigFile.Redis.Enabled {
-		var err error
-		store, err = redis.NewStore(config.Redis)
-		if err != nil {
-			log.Fatal(err)
-		}
-	} else {
-		store = memory.NewStore()
-	}
-
-	ipRateLimiter := limiter.New(store, *config.Rate)
+	ipRateLimiter := limiter.New(config.RateLimitStore, *config.Rate)
+	policy := fmt.Sprintf("%d;w=%d", config.Rate.Limit, int64(config.Rate.Period.Seconds()))
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) (err error) {
@@ -32,20 +22,32 @@ func RateLimit(config *config.Config) echo.MiddlewareFunc {
 				return next(c)
 			}
 			ip := c.RealIP()
+			if config.ConfigFile.AllowIPs.BypassRateLimit && config.AllowIPsTable.ContainsString(ip) {
+				return next(c)
+			}
+
 			limiterCtx, err := ipRateLimiter.Get(c.Request().Context(), ip)
 			if err != nil {
-				return c.JSON(http.StatusInternalServerError, echo.Map{
+				config.Logger.Error().
+					Err(err).
+					Str("ip", ip).
+					Bool("fail_open", config.ConfigFile.RateLimit.FailOpen).
+					Msg("rate limit store unavailable")
+
+				if config.ConfigFile.RateLimit.FailOpen {
+					return next(c)
+				}
+
+				c.Response().Header().Set("Retry-After", "1")
+				return c.JSON(http.StatusServiceUnavailable, echo.Map{
 					"success": false,
-					"message": err,
+					"message": "Rate limit temporarily unavailable",
 				})
 			}
 
-			h := c.Response().Header()
-			h.Set("X-RateLimit-Limit", strconv.FormatInt(limiterCtx.Limit, 10))
-			h.Set("X-RateLimit-Remaining", strconv.FormatInt(limiterCtx.Remaining, 10))
-			h.Set("X-RateLimit-Reset", strconv.FormatInt(limiterCtx.Reset, 10))
-
+			setRateLimitHeaders(c, limiterCtx, policy)
 			if limiterCtx.Reached {
+				c.Set("offense", bans.ReasonRateLimited)
 				return c.JSON(http.StatusTooManyRequests, echo.Map{
 					"success": false,
 					"message": "Too Many Requests on " + c.Request().URL.String(),
@@ -56,3 +58,24 @@ func RateLimit(config *config.Config) echo.MiddlewareFunc {
 		}
 	}
 }
+
+// setRateLimitHeaders describes the state of the limit to the client, with
+// a Retry-After when the limit is reached.
+func setRateLimitHeaders(c echo.Context, limiterCtx limiter.Context, policy string) {
+	// Seconds until the current window resets, as required by
+	// Retry-After and the IETF RateLimit fields.
+	resetIn := limiterCtx.Reset - time.Now().Unix()
+	if resetIn < 0 {
+		resetIn = 0
+	}
+
+	h := c.Response().Header()
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(limiterCtx.Limit, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(limiterCtx.Remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(limiterCtx.Reset, 10))
+	h.Set("RateLimit-Policy", policy)
+	h.Set("RateLimit", fmt.Sprintf("limit=%d, remaining=%d, reset=%d", limiterCtx.Limit, limiterCtx.Remaining, resetIn))
+	if limiterCtx.Reached {
+		h.Set("Retry-After", strconv.FormatInt(resetIn, 10))
+	}
+}
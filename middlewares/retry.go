@@ -2,109 +2,174 @@ package middlewares
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
-	"strings"
-	"regexp"
-	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/marigold-dev/tzproxy/tezos"
 )
 
-// Compile the regular expression once and store it in a global variable
-var statusCodeRegex = regexp.MustCompile(`code=(\d+)`)
-
+// Retry sends the requests matched by a retry rule again after a backoff,
+// while the status is retryable, attempts are left and the retry budget
+// allows it. The decision to hold a response is made on its status, before
+// its body: other responses are streamed to the client, and retryable ones
+// are held only while their body is small.
 func Retry(config *config.Config) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) (err error) {
-			if config.ConfigFile.TezosHostRetry == "" ||
-				strings.Contains(c.Request().URL.Path, "mempool") ||
-				strings.Contains(c.Request().URL.Path, "monitor") {
+			// Every proxied request counts toward the budget, retryable or not
+			config.RetryBudget.Request()
+			method := c.Request().Method
+			path := c.Request().URL.Path
+			if !config.IsRetryable(method, path) {
 				return next(c)
 			}
 
-			writer := newDelayedResponseWriter(c)
-			delayedResponse := echo.NewResponse(&writer, c.Echo())
+			attempt := 1
+			retryable := func(status int) bool {
+				upstreamErr, _ := c.Get("_error").(error)
+				return attempt < config.ConfigFile.Retry.MaxAttempts &&
+					config.MayRetry(method, path, status, upstreamErr)
+			}
+
+			response := c.Response()
+			writer := newDelayedResponseWriter(c, retryable, config.ConfigFile.Retry.BufferMaxBytes)
+			delayedResponse := echo.NewResponse(writer, c.Echo())
 			c.SetResponse(delayedResponse)
 
 			// Read the request body
 			bodyBytes, _ := io.ReadAll(c.Request().Body)
-			// Replace the request body with a buffer
-			c.Request().Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	
-			statusFromMsg := 0
-			err = next(c)
-
-			status := c.Response().Status
-			// Extract the status code from the error message
-			if err != nil {
-				match := statusCodeRegex.FindStringSubmatch(err.Error())
-				if len(match) > 1 {
-					statusFromMsg, _ = strconv.Atoi(match[1])
+
+			// The hosts of the targets attempted, in order
+			attempted := []string{}
+			status := 0
+			for ; ; attempt++ {
+				// Replace the request body with a buffer
+				c.Request().Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+				err = next(c)
+				if target, ok := c.Get("target").(*middleware.ProxyTarget); ok {
+					attempted = append(attempted, target.URL.Host)
 				}
-			}
-			// Check the request method and path
-			method := c.Request().Method
-			path := c.Request().URL.Path
-			shouldRetry := (method == http.MethodGet && (status == http.StatusNotFound || status == http.StatusForbidden)) ||
-				(method == http.MethodPost && statusFromMsg == 502 &&
-				strings.Contains(path, "/chains/main/blocks/head/helpers/scripts/"))
 
-			if err != nil && statusFromMsg == 502 {
-				c.Logger().Infof("Error occurred with status 502. Request method: %s, path: %s, response status: %d", method, path, statusFromMsg)
-				c.Logger().Infof("Should retry: %v", shouldRetry)
-			}
+				status = delayedResponse.Status
+				var httpErr *echo.HTTPError
+				if errors.As(err, &httpErr) {
+					status = httpErr.Code
+				}
+				upstreamErr, _ := c.Get("_error").(error)
+
+				// The response is already sent
+				if writer.sent || attempt >= config.ConfigFile.Retry.MaxAttempts {
+					break
+				}
+				// The Tezos errors are in the body of the held response
+				rpcErrors := tezos.ParseErrors(writer.buf.Bytes())
+				retry, fallbackOnly := config.ShouldRetry(method, path, status, rpcErrors, upstreamErr)
+				if !retry {
+					break
+				}
+				if !config.RetryBudget.Withdraw() {
+					metrics.Retries.WithLabelValues("budget_exhausted").Inc()
+					config.Logger.Warn().
+						Int("status", status).
+						Str("method", method).
+						Str("uri", path).
+						Msg("retry budget exhausted")
+					break
+				}
+				// A retry never goes to a target already attempted. Picking
+				// a target may take a probe of its circuit breaker, which
+				// is released when the retry isn't sent.
+				minLevel, _ := c.Get("min_level").(int64)
+				target := config.Fallbacks.Next(attempted, fallbackOnly, minLevel)
+				if target == nil {
+					config.RetryBudget.Refund()
+					metrics.Retries.WithLabelValues("no_target").Inc()
+					break
+				}
+				metrics.Retries.WithLabelValues("retried").Inc()
+				config.Logger.Info().
+					Int("attempt", attempt+1).
+					Int("status", status).
+					Str("method", method).
+					Str("uri", path).
+					Strs("errors", tezos.IDs(rpcErrors)).
+					Strs("attempted", attempted).
+					Str("target", target.URL.Host).
+					Msg("retrying request")
+				if !sleep(c.Request().Context(), config.RetryBackoff(attempt)) {
+					config.Breakers.Release(target.URL.Host)
+					config.RetryBudget.Refund()
+					break
+				}
 
-			if shouldRetry {
-				c.Logger().Infof("Triggering retry for http status %d", status)
 				writer.Reset()
 				delayedResponse.Committed = false
 				delayedResponse.Size = 0
 				delayedResponse.Status = 0
-				c.Set("retry", status)
+				c.Set("retry", target)
 
 				// This _error key comes from Echo (referenced in ProxyWithConfig middleware)
 				// so we need to reset this as well.
 				c.Set("_error", nil)
-
-				// Reset the request body
-				c.Request().Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-
-				err = next(c)
-				// Log the status after the retry attempt
-				c.Logger().Infof("Retry attempt http status: %d", c.Response().Status)
-				// Extract the status code from the response body for the retry attempt
-				statusFromMsgRetry := 0
-				if err != nil {
-					match := statusCodeRegex.FindStringSubmatch(err.Error())
-					if len(match) > 1 {
-						statusFromMsgRetry, _ = strconv.Atoi(match[1])
-					}
-				}
-				retryFailed := statusFromMsgRetry == 502 || c.Response().Status == http.StatusNotFound || c.Response().Status == http.StatusForbidden
-				if retryFailed {
-					c.Logger().Infof("Retry attempt http status: %d, code found in body: %d", c.Response().Status, statusFromMsgRetry)
-				} else {
-					c.Logger().Infof("Retry attempt succeeded with http status: %d, code found in body: %d", c.Response().Status, statusFromMsgRetry)
-				}
 			}
 
 			c.Set("retry", nil)
-			if delayedWriter, ok := c.Response().Writer.(*delayedResponseWriter); ok {
-				if commitErr := delayedWriter.Commit(); commitErr != nil {
-					c.Logger().Error(commitErr)
-				}
+			if len(attempted) > 1 {
+				config.Logger.Info().
+					Int("status", status).
+					Str("method", method).
+					Str("uri", path).
+					Strs("targets", attempted).
+					Msg("retry chain")
+			}
+			if commitErr := writer.Commit(); commitErr != nil {
+				c.Logger().Error(commitErr)
 			}
+			// An error left is written by the error handler, which must not
+			// write it to the buffer
+			c.SetResponse(response)
 			return err
 		}
 	}
 }
 
+// sleep waits for the delay, and reports false if the request is canceled
+// in the meantime.
+func sleep(ctx context.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// delayedResponseWriter holds the responses whose status is retryable, so
+// that they can be discarded for a retry, and writes the others through.
 type delayedResponseWriter struct {
 	originalResponse http.ResponseWriter
-	statusCode       int
-	buf              *bytes.Buffer
+	// header is the header set before the first attempt, restored on Reset
+	header     http.Header
+	retryable  func(status int) bool
+	statusCode int
+	buf        *bytes.Buffer
+	// limit is the body size above which a held response is sent anyway
+	limit int64
+	held  bool
+	// sent is set once the response is written to the client
+	sent bool
 }
 
 // Header returns the map of header fields.
@@ -112,14 +177,37 @@ func (d *delayedResponseWriter) Header() http.Header {
 	return d.originalResponse.Header()
 }
 
-// Write records the body content to send when Commit is called.
-func (d *delayedResponseWriter) Write(bytes []byte) (int, error) {
-	return d.buf.Write(bytes)
-}
-
-// WriteHeader records the statusCode to send when Commit is called.
+// WriteHeader holds the response when its status is retryable, and sends
+// the header otherwise.
 func (d *delayedResponseWriter) WriteHeader(statusCode int) {
+	if d.held || d.sent {
+		return
+	}
 	d.statusCode = statusCode
+	if d.retryable(statusCode) {
+		d.held = true
+		return
+	}
+	d.sent = true
+	d.originalResponse.WriteHeader(statusCode)
+}
+
+// Write records the body of a held response, and writes the others
+// through. Past the limit, the held response is sent, and can no longer be
+// retried.
+func (d *delayedResponseWriter) Write(bytes []byte) (int, error) {
+	if !d.held && !d.sent {
+		d.WriteHeader(http.StatusOK)
+	}
+	if d.held && d.limit > 0 && int64(d.buf.Len()+len(bytes)) > d.limit {
+		if err := d.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	if d.held {
+		return d.buf.Write(bytes)
+	}
+	return d.originalResponse.Write(bytes)
 }
 
 // Flush implements the http.Flusher interface to allow an HTTP handler to flush
@@ -127,26 +215,44 @@ func (d *delayedResponseWriter) WriteHeader(statusCode int) {
 // See [http.Flusher](https://golang.org/pkg/net/http/#Flusher)
 // This is required for some content types such as octet-stream (for files download)
 func (d *delayedResponseWriter) Flush() {
-	d.originalResponse.(http.Flusher).Flush()
+	if !d.held {
+		d.originalResponse.(http.Flusher).Flush()
+	}
 }
 
-// Reset resets the internal buffer and status code.
+// Reset discards the held response and restores the header.
 func (d *delayedResponseWriter) Reset() {
 	d.buf.Reset()
 	d.statusCode = 0
+	d.held = false
+	header := d.originalResponse.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	for key, values := range d.header {
+		header[key] = values
+	}
 }
 
-// Commit sends the header and body content to the original response writer.
+// Commit sends the held response to the original response writer.
 func (d *delayedResponseWriter) Commit() (err error) {
-	if d.statusCode != 0 {
-		d.originalResponse.WriteHeader(d.statusCode)
+	if !d.held {
+		return nil
 	}
+	d.held = false
+	d.sent = true
+	d.originalResponse.WriteHeader(d.statusCode)
 	_, err = d.originalResponse.Write(d.buf.Bytes())
+	d.buf.Reset()
 	return
 }
 
-func newDelayedResponseWriter(c echo.Context) delayedResponseWriter {
-	return delayedResponseWriter{
+func newDelayedResponseWriter(c echo.Context, retryable func(int) bool, limit int64) *delayedResponseWriter {
+	return &delayedResponseWriter{
 		originalResponse: c.Response(),
-		buf:              new(bytes.Buffer)}
+		header:           c.Response().Header().Clone(),
+		retryable:        retryable,
+		buf:              new(bytes.Buffer),
+		limit:            limit,
+	}
 }
@@ -0,0 +1,168 @@
+package middlewares
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/marigold-dev/tzproxy/config"
+	"github.com/marigold-dev/tzproxy/nodes"
+	"github.com/marigold-dev/tzproxy/tezos"
+)
+
+const (
+	headerBlockHash = "X-Tezos-Block-Hash"
+	headerLevel     = "X-Tezos-Level"
+)
+
+// SessionConsistency keeps the clients from going back in the chain: their
+// requests relative to the head of the main chain are sent to the nodes that
+// reached the highest head they were served. When none of them can be
+// picked, the head is replaced by the hash of that block if rewrite_head is
+// set, and the request still goes to the nodes that reached it first.
+//
+// The block served is only known when the head was replaced by the hash of
+// the session, or from the response of the header and hash RPCs. It is then
+// returned in the X-Tezos-Block-Hash and X-Tezos-Level headers. When it is
+// the head of the node, it raises the session and the head known for the
+// node.
+func SessionConsistency(config *config.Config) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !config.ConfigFile.SessionConsistency.Enabled {
+				return next(c)
+			}
+			r := c.Request()
+			block, ok := tezos.ParseBlockPath(r.URL.Path)
+			if !ok || block.Chain != "main" || !block.Block.IsHead() {
+				return next(c)
+			}
+			isHead := block.Block.Canonical().Offset == ""
+
+			ctx := r.Context()
+			client := clientKey(c, config.ConfigFile.SessionConsistency.KeyHeader)
+			seen, hasSeen := config.Sessions.Get(ctx, client)
+			rewritten := false
+			if hasSeen {
+				c.Set("min_level", seen.Level)
+				if config.ConfigFile.SessionConsistency.RewriteHead && !config.Fallbacks.Reached(seen.Level) {
+					r.URL.Path = block.WithBase(seen.Hash).String()
+					r.URL.RawPath = ""
+					rewritten = true
+				}
+			}
+
+			if rewritten && isHead {
+				// The head of the session is served
+				c.Response().Before(func() {
+					if c.Response().Status < http.StatusBadRequest {
+						setServedBlock(c.Response().Header(), seen)
+					}
+				})
+				return next(c)
+			}
+			if block.Rest != "/header" && block.Rest != "/hash" {
+				return next(c)
+			}
+
+			// The response is held until the block served is read from it
+			res := c.Response()
+			held := &heldResponse{ResponseWriter: res.Writer}
+			res.Writer = held
+			err := next(c)
+			res.Writer = held.ResponseWriter
+
+			if held.status == http.StatusOK {
+				if served, ok := servedBlock(config, block.Rest, res.Header(), held.body.Bytes()); ok {
+					setServedBlock(res.Header(), served)
+					if isHead && !rewritten {
+						if target, ok := c.Get("target").(*middleware.ProxyTarget); ok {
+							config.Heads.Observe(target.URL.Host, served)
+						}
+						if updateErr := config.Sessions.Update(ctx, client, served); updateErr != nil {
+							config.Logger.Warn().Err(updateErr).Str("client", client).Msg("unable to update session")
+						}
+					}
+				}
+			}
+			if commitErr := held.commit(); commitErr != nil {
+				c.Logger().Error(commitErr)
+			}
+			return err
+		}
+	}
+}
+
+func setServedBlock(header http.Header, served nodes.Head) {
+	header.Set(headerBlockHash, served.Hash)
+	header.Set(headerLevel, strconv.FormatInt(served.Level, 10))
+}
+
+// servedBlock reads the block served from the response of the header or the
+// hash RPC. The level of a hash is only known when it was polled as a head.
+func servedBlock(config *config.Config, rpc string, header http.Header, body []byte) (nodes.Head, bool) {
+	var reader io.Reader = bytes.NewReader(body)
+	if header.Get(echo.HeaderContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nodes.Head{}, false
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	var served nodes.Head
+	switch rpc {
+	case "/header":
+		if err := json.NewDecoder(reader).Decode(&served); err != nil {
+			return nodes.Head{}, false
+		}
+	case "/hash":
+		if err := json.NewDecoder(reader).Decode(&served.Hash); err != nil {
+			return nodes.Head{}, false
+		}
+		level, ok := config.Heads.Level(served.Hash)
+		if !ok {
+			return nodes.Head{}, false
+		}
+		served.Level = level
+	}
+	return served, tezos.IsBlockHash(served.Hash)
+}
+
+// heldResponse holds a response, so that its headers can still be set once
+// its body is written.
+type heldResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (h *heldResponse) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *heldResponse) Write(b []byte) (int, error) {
+	h.WriteHeader(http.StatusOK)
+	return h.body.Write(b)
+}
+
+// Flush does nothing, the response being sent at once by commit.
+func (h *heldResponse) Flush() {}
+
+// commit sends the response held, if any.
+func (h *heldResponse) commit() error {
+	if h.status == 0 {
+		return nil
+	}
+	h.ResponseWriter.WriteHeader(h.status)
+	_, err := h.body.WriteTo(h.ResponseWriter)
+	return err
+}
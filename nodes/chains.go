@@ -0,0 +1,148 @@
+package nodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/rs/zerolog"
+)
+
+// checkTimeout is the longest a node has to answer a check.
+const checkTimeout = 5 * time.Second
+
+// ChainTarget is a node and the chain it must be on.
+type ChainTarget struct {
+	URL     *url.URL
+	ChainID string
+}
+
+// ChainChecker checks that the nodes are on their expected chain. The nodes
+// found on another chain are refused until they are back on it, while the
+// ones not checked yet or that didn't answer are allowed. A nil ChainChecker
+// allows every node.
+type ChainChecker struct {
+	client   *http.Client
+	targets  []ChainTarget
+	interval time.Duration
+	logger   zerolog.Logger
+	mutex    sync.RWMutex
+	// wrong are the chains of the nodes on another chain, by host
+	wrong map[string]string
+	done  chan struct{}
+}
+
+func NewChainChecker(targets []ChainTarget, transport http.RoundTripper, interval time.Duration, logger zerolog.Logger) *ChainChecker {
+	return &ChainChecker{
+		client:   &http.Client{Transport: transport},
+		targets:  targets,
+		interval: interval,
+		logger:   logger,
+		wrong:    make(map[string]string),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start checks the nodes before returning, so that no request is sent to a
+// node on another chain, then checks them again on every interval until
+// Close.
+func (c *ChainChecker) Start() {
+	c.check()
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.check()
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the checks.
+func (c *ChainChecker) Close() {
+	close(c.done)
+}
+
+// Allow reports whether requests can be sent to host.
+func (c *ChainChecker) Allow(host string) bool {
+	if c == nil {
+		return true
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, wrong := c.wrong[host]
+	return !wrong
+}
+
+func (c *ChainChecker) check() {
+	var wg sync.WaitGroup
+	for _, target := range c.targets {
+		wg.Add(1)
+		go func(target ChainTarget) {
+			defer wg.Done()
+			host := target.URL.Host
+			chainID, err := c.fetch(target.URL)
+			if err != nil {
+				c.logger.Debug().Err(err).Str("target", host).Msg("unable to check chain id")
+				return
+			}
+
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			if chainID != target.ChainID {
+				c.wrong[host] = chainID
+				metrics.WrongChain.WithLabelValues(host).Set(1)
+				c.logger.Error().
+					Str("target", host).
+					Str("expected", target.ChainID).
+					Str("chain_id", chainID).
+					Msg("node is on the wrong chain, no request is sent to it")
+				return
+			}
+			if _, wrong := c.wrong[host]; wrong {
+				delete(c.wrong, host)
+				c.logger.Warn().
+					Str("target", host).
+					Str("chain_id", chainID).
+					Msg("node is back on the expected chain")
+			}
+			metrics.WrongChain.WithLabelValues(host).Set(0)
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (c *ChainChecker) fetch(target *url.URL) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.JoinPath("/chains/main/chain_id").String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	// The chain id is a JSON string
+	var chainID string
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxHeaderBytes)).Decode(&chainID); err != nil {
+		return "", err
+	}
+	return chainID, nil
+}
@@ -0,0 +1,185 @@
+package nodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/rs/zerolog"
+)
+
+// maxHeaderBytes is the size of the largest block header read.
+const maxHeaderBytes = 1 << 20
+
+// historySize is the number of heads whose level is remembered.
+const historySize = 1000
+
+// Head is the head block of a node.
+type Head struct {
+	Level int64  `json:"level"`
+	Hash  string `json:"hash"`
+}
+
+// HeadTracker polls the head of the nodes, to tell the ones that are behind.
+// A nil HeadTracker knows no head.
+type HeadTracker struct {
+	client   *http.Client
+	targets  []*url.URL
+	interval time.Duration
+	logger   zerolog.Logger
+	mutex    sync.RWMutex
+	heads    map[string]Head
+	// levels are the levels of the last heads polled, by hash
+	levels  map[string]int64
+	history []string
+	done    chan struct{}
+}
+
+func NewHeadTracker(targets []*url.URL, transport http.RoundTripper, interval time.Duration, logger zerolog.Logger) *HeadTracker {
+	return &HeadTracker{
+		client:   &http.Client{Transport: transport},
+		targets:  targets,
+		interval: interval,
+		logger:   logger,
+		heads:    make(map[string]Head),
+		levels:   make(map[string]int64),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start polls the heads right away, then on every interval until Close.
+func (t *HeadTracker) Start() {
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			t.poll()
+			select {
+			case <-ticker.C:
+			case <-t.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the polling.
+func (t *HeadTracker) Close() {
+	close(t.done)
+}
+
+// Head returns the last head polled on host.
+func (t *HeadTracker) Head(host string) (Head, bool) {
+	if t == nil {
+		return Head{}, false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	head, ok := t.heads[host]
+	return head, ok
+}
+
+// Observe records a head served by host ahead of the next poll, so that a
+// node isn't taken for behind a head it just served. It is ignored for the
+// hosts whose head isn't polled yet, such as the fallbacks, and for heads
+// below the last one known.
+func (t *HeadTracker) Observe(host string, head Head) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	last, ok := t.heads[host]
+	if !ok || last.Level >= head.Level {
+		return
+	}
+	t.heads[host] = head
+	t.remember(head)
+	metrics.HeadLevel.WithLabelValues(host).Set(float64(head.Level))
+}
+
+// Level returns the level of a block that was the head of a node, among the
+// last ones polled.
+func (t *HeadTracker) Level(hash string) (int64, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	level, ok := t.levels[hash]
+	return level, ok
+}
+
+// Behind reports whether the last head polled on host is below level. A
+// host whose head is unknown is not behind.
+func (t *HeadTracker) Behind(host string, level int64) bool {
+	head, ok := t.Head(host)
+	return ok && head.Level < level
+}
+
+// poll fetches the head of every node. The last head of a node that fails
+// to answer is kept, so it falls behind as the others move on.
+func (t *HeadTracker) poll() {
+	var wg sync.WaitGroup
+	for _, target := range t.targets {
+		wg.Add(1)
+		go func(target *url.URL) {
+			defer wg.Done()
+			head, err := t.fetch(target)
+			if err != nil {
+				t.logger.Debug().Err(err).Str("target", target.Host).Msg("unable to poll head")
+				return
+			}
+			t.mutex.Lock()
+			t.heads[target.Host] = head
+			t.remember(head)
+			t.mutex.Unlock()
+			metrics.HeadLevel.WithLabelValues(target.Host).Set(float64(head.Level))
+		}(target)
+	}
+	wg.Wait()
+}
+
+// remember records the level of head, forgetting the oldest one past the
+// size of the history.
+func (t *HeadTracker) remember(head Head) {
+	if _, ok := t.levels[head.Hash]; ok {
+		return
+	}
+	t.levels[head.Hash] = head.Level
+	t.history = append(t.history, head.Hash)
+	if len(t.history) > historySize {
+		delete(t.levels, t.history[0])
+		t.history = t.history[1:]
+	}
+}
+
+func (t *HeadTracker) fetch(target *url.URL) (Head, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.JoinPath("/chains/main/blocks/head/header").String(), nil)
+	if err != nil {
+		return Head{}, err
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return Head{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return Head{}, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	var head Head
+	if err := json.NewDecoder(io.LimitReader(res.Body, maxHeaderBytes)).Decode(&head); err != nil {
+		return Head{}, err
+	}
+	return head, nil
+}
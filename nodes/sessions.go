@@ -0,0 +1,50 @@
+package nodes
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	echocache "github.com/fraidev/go-echo-cache"
+)
+
+// Sessions remembers the highest head served to each client, for ttl
+// seconds after it was last raised.
+type Sessions struct {
+	store echocache.Cache
+	ttl   int
+}
+
+func NewSessions(store echocache.Cache, ttl int) *Sessions {
+	return &Sessions{store: store, ttl: ttl}
+}
+
+// Get returns the highest head served to the client.
+func (s *Sessions) Get(ctx context.Context, client string) (Head, bool) {
+	value, err := s.store.Get(ctx, key(client))
+	if err != nil || len(value) == 0 {
+		return Head{}, false
+	}
+	level, hash, ok := strings.Cut(string(value), " ")
+	if !ok {
+		return Head{}, false
+	}
+	head := Head{Hash: hash}
+	head.Level, err = strconv.ParseInt(level, 10, 64)
+	return head, err == nil
+}
+
+// Update records the head served to the client when it is higher than the
+// one it was served before. Concurrent requests of a client may race, the
+// session is then only as high as one of them.
+func (s *Sessions) Update(ctx context.Context, client string, head Head) error {
+	if seen, ok := s.Get(ctx, client); ok && seen.Level >= head.Level {
+		return nil
+	}
+	value := strconv.FormatInt(head.Level, 10) + " " + head.Hash
+	return s.store.Set(ctx, key(client), []byte(value), s.ttl)
+}
+
+func key(client string) []byte {
+	return []byte("session:" + client)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+	"github.com/marigold-dev/tzproxy/config"
+)
+
+// reloadableHandler runs the middleware chain built from the current
+// configuration. A reload builds a whole new chain and swaps it atomically,
+// requests in flight finish with the chain they started with.
+type reloadableHandler struct {
+	mutex  sync.Mutex
+	build  func(*config.Config) []echo.MiddlewareFunc
+	config atomic.Pointer[config.Config]
+	chain  atomic.Pointer[echo.HandlerFunc]
+}
+
+func newReloadableHandler(config *config.Config, build func(*config.Config) []echo.MiddlewareFunc) *reloadableHandler {
+	h := &reloadableHandler{build: build}
+	h.swap(config)
+	return h
+}
+
+func (h *reloadableHandler) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		chain := h.chain.Load()
+		return (*chain)(c)
+	}
+}
+
+func (h *reloadableHandler) ExtractIP(r *http.Request) string {
+	return h.config.Load().IPExtractor(r)
+}
+
+func (h *reloadableHandler) Config() *config.Config {
+	return h.config.Load()
+}
+
+// Reload validates the configuration file and applies it. The running
+// configuration is kept when the file is invalid.
+func (h *reloadableHandler) Reload(trigger string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	current := h.config.Load()
+	next, err := current.Reload()
+	if err != nil {
+		current.Logger.Error().Err(err).Str("trigger", trigger).Msg("configuration reload failed")
+		return err
+	}
+
+	h.swap(next)
+	current.Release(next)
+	next.Logger.Info().Str("trigger", trigger).Msg("configuration reloaded")
+	return nil
+}
+
+func (h *reloadableHandler) swap(config *config.Config) {
+	chain := echo.HandlerFunc(func(c echo.Context) error {
+		return echo.ErrNotFound
+	})
+	middlewares := h.build(config)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		chain = middlewares[i](chain)
+	}
+
+	h.config.Store(config)
+	h.chain.Store(&chain)
+}
+
+// watchReload reloads the configuration when the file changes or when
+// the process receives a SIGHUP.
+func watchReload(h *reloadableHandler) {
+	config.OnConfigFileChange(func() {
+		h.Reload("file")
+	})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			h.Reload("signal")
+		}
+	}()
+}
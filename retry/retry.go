@@ -0,0 +1,108 @@
+package retry
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Budget caps the retries to a share of the requests, so that retrying
+// cannot multiply the load on nodes that are already failing. The counts
+// are kept over fixed windows. A nil Budget allows every retry.
+type Budget struct {
+	mutex      sync.Mutex
+	ratio      float64
+	minRetries int
+	window     time.Duration
+	start      time.Time
+	requests   int
+	retries    int
+}
+
+// NewBudget allows percent retries for every hundred requests, and at least
+// minRetries in each window.
+func NewBudget(percent int, minRetries int, window time.Duration) *Budget {
+	return &Budget{
+		ratio:      float64(percent) / 100,
+		minRetries: minRetries,
+		window:     window,
+		start:      time.Now(),
+	}
+}
+
+// Configure replaces the share of retries and the minimum, keeping the
+// counts of the current window.
+func (b *Budget) Configure(percent int, minRetries int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ratio = float64(percent) / 100
+	b.minRetries = minRetries
+}
+
+func (b *Budget) roll(now time.Time) {
+	if now.Sub(b.start) >= b.window {
+		b.start = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// Request counts a request toward the traffic the budget is a share of.
+func (b *Budget) Request() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll(time.Now())
+	b.requests++
+}
+
+// Withdraw reports whether a retry can be sent, and counts it if so.
+func (b *Budget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.roll(time.Now())
+	if b.retries >= b.minRetries && float64(b.retries+1) > b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// Refund gives back a retry withdrawn but not sent.
+func (b *Budget) Refund() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.retries > 0 {
+		b.retries--
+	}
+}
+
+// Backoff returns the delay before the given retry, counting from 1. It
+// doubles from base on every retry up to max, 0 meaning no maximum. With
+// jitter, a random delay between half and all of it is returned, to spread
+// the retries of clients that failed at the same time.
+func Backoff(retry int, base, max time.Duration, jitter bool) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < retry && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	if jitter {
+		half := delay / 2
+		delay = half + time.Duration(rand.Int63n(int64(delay-half)+1))
+	}
+	return delay
+}
@@ -0,0 +1,120 @@
+package retry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	const ms = time.Millisecond
+
+	tests := []struct {
+		name  string
+		retry int
+		base  time.Duration
+		max   time.Duration
+		want  time.Duration
+	}{
+		{"no backoff", 3, 0, 100 * ms, 0},
+		{"first retry", 1, 10 * ms, 100 * ms, 10 * ms},
+		{"second retry", 2, 10 * ms, 100 * ms, 20 * ms},
+		{"third retry", 3, 10 * ms, 100 * ms, 40 * ms},
+		{"capped", 5, 10 * ms, 100 * ms, 100 * ms},
+		{"capped after many retries", 100, 10 * ms, 100 * ms, 100 * ms},
+		{"max below base", 1, 10 * ms, 5 * ms, 5 * ms},
+		{"no max", 4, 10 * ms, 0, 80 * ms},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Backoff(tt.retry, tt.base, tt.max, false); got != tt.want {
+				t.Errorf("Backoff(%d, %v, %v) = %v, want %v", tt.retry, tt.base, tt.max, got, tt.want)
+			}
+			for i := 0; i < 100; i++ {
+				got := Backoff(tt.retry, tt.base, tt.max, true)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("Backoff(%d, %v, %v) with jitter = %v, want between %v and %v", tt.retry, tt.base, tt.max, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBudgetWithdraw(t *testing.T) {
+	tests := []struct {
+		name       string
+		percent    int
+		minRetries int
+		requests   int
+		want       int
+	}{
+		{"minimum only", 0, 3, 100, 3},
+		{"share of the requests", 20, 0, 100, 20},
+		{"minimum above the share", 20, 10, 10, 10},
+		{"share above the minimum", 50, 10, 100, 50},
+		{"no request", 20, 0, 0, 0},
+		{"no retry", 0, 0, 100, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBudget(tt.percent, tt.minRetries, time.Hour)
+			for i := 0; i < tt.requests; i++ {
+				b.Request()
+			}
+			got := 0
+			for b.Withdraw() {
+				got++
+				if got > tt.requests+tt.minRetries {
+					t.Fatal("the budget is never exhausted")
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%d retries allowed, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBudgetWindow(t *testing.T) {
+	b := NewBudget(0, 1, 10*time.Millisecond)
+	if !b.Withdraw() || b.Withdraw() {
+		t.Fatal("want a single retry in the window")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !b.Withdraw() {
+		t.Error("the budget is not renewed with the window")
+	}
+}
+
+func TestBudgetConfigure(t *testing.T) {
+	b := NewBudget(0, 1, time.Hour)
+	if !b.Withdraw() {
+		t.Fatal("want a retry")
+	}
+	// The retry already counted is kept
+	b.Configure(0, 2)
+	if !b.Withdraw() || b.Withdraw() {
+		t.Error("want a single retry left")
+	}
+}
+
+func TestBudgetRefund(t *testing.T) {
+	b := NewBudget(0, 1, time.Hour)
+	if !b.Withdraw() || b.Withdraw() {
+		t.Fatal("want a single retry in the window")
+	}
+	b.Refund()
+	if !b.Withdraw() {
+		t.Error("the retry refunded is not available")
+	}
+}
+
+func TestNilBudget(t *testing.T) {
+	var b *Budget
+	b.Request()
+	b.Refund()
+	if !b.Withdraw() {
+		t.Error("a nil Budget must allow every retry")
+	}
+}
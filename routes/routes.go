@@ -0,0 +1,189 @@
+// Package routes matches request paths against route rules.
+//
+// A rule is a method followed by an anchored path, such as
+// "GET /chains/{chain}/blocks/{block}/header". The method can be * to match
+// them all. Each path segment is either:
+//
+//   - a literal, matched exactly;
+//   - a placeholder {name} or {name:type}, matching a single segment. The type
+//     is one of any, int, hash, chain, block, head or contract. When omitted,
+//     the name is used as the type if it is one, otherwise any;
+//   - *, matching any single segment;
+//   - **, as the last segment only, matching any number of segments,
+//     including none.
+//
+// A trailing slash is ignored, so /version/ matches the same rules as
+// /version.
+//
+// Rules without a space after the method, such as "GET/chains/.*/blocks",
+// are unanchored regular expressions kept for compatibility.
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var allMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete,
+	http.MethodPatch, http.MethodHead, http.MethodOptions,
+}
+
+// Matcher tells whether a request matches a set of rules. Structured rules
+// are stored in one trie per method, so a lookup only walks the segments of
+// the path regardless of the number of rules. A nil Matcher matches nothing.
+type Matcher struct {
+	trees  map[string]*node
+	legacy map[string][]legacyRule
+}
+
+type legacyRule struct {
+	rule  string
+	regex *regexp.Regexp
+}
+
+// Compile parses the rules into a Matcher.
+func Compile(rules []string) (*Matcher, error) {
+	m := &Matcher{
+		trees:  map[string]*node{},
+		legacy: map[string][]legacyRule{},
+	}
+	for _, rule := range rules {
+		if err := m.add(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// MustCompile is like Compile but panics if a rule is invalid.
+func MustCompile(rules ...string) *Matcher {
+	m, err := Compile(rules)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func (m *Matcher) add(rule string) error {
+	method, path, structured := strings.Cut(rule, " ")
+	path = strings.TrimSpace(path)
+	if !structured || !strings.HasPrefix(path, "/") {
+		return m.addLegacy(rule)
+	}
+
+	methods := []string{strings.ToUpper(method)}
+	if method == "*" {
+		methods = allMethods
+	} else if !contains(allMethods, methods[0]) {
+		return fmt.Errorf("invalid route %q: unknown method %q", rule, method)
+	}
+
+	segments, err := parseSegments(path)
+	if err != nil {
+		return fmt.Errorf("invalid route %q: %w", rule, err)
+	}
+	for _, method := range methods {
+		root, ok := m.trees[method]
+		if !ok {
+			root = &node{}
+			m.trees[method] = root
+		}
+		root.insert(segments, rule)
+	}
+
+	return nil
+}
+
+// addLegacy keeps the behavior of the regular expression routes: an
+// optional method prefix followed by an unanchored expression.
+func (m *Matcher) addLegacy(rule string) error {
+	if !containsPrefix(rule, allMethods) {
+		regex, err := regexp.Compile(rule)
+		if err != nil {
+			return fmt.Errorf("unable to compile regex %q: %w", rule, err)
+		}
+		for _, method := range allMethods {
+			m.legacy[method] = append(m.legacy[method], legacyRule{rule, regex})
+		}
+		return nil
+	}
+
+	for _, method := range allMethods {
+		if strings.HasPrefix(strings.ToUpper(rule), method) {
+			regex, err := regexp.Compile(strings.TrimPrefix(rule, method))
+			if err != nil {
+				return fmt.Errorf("unable to compile regex %q: %w", rule, err)
+			}
+			m.legacy[method] = append(m.legacy[method], legacyRule{rule, regex})
+			break
+		}
+	}
+
+	return nil
+}
+
+// Match reports whether any rule matches the request.
+func (m *Matcher) Match(method, path string) bool {
+	if m == nil {
+		return false
+	}
+	if root, ok := m.trees[method]; ok && root.match(trimPath(path), nil) {
+		return true
+	}
+	for _, legacy := range m.legacy[method] {
+		if legacy.regex.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns every rule matching the request, as written.
+func (m *Matcher) Matches(method, path string) []string {
+	matches := []string{}
+	if m == nil {
+		return matches
+	}
+	if root, ok := m.trees[method]; ok {
+		root.match(trimPath(path), &matches)
+	}
+	for _, legacy := range m.legacy[method] {
+		if legacy.regex.MatchString(path) {
+			matches = append(matches, legacy.rule)
+		}
+	}
+	return matches
+}
+
+func trimSlash(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// trimPath removes the leading slash of a request path and its trailing
+// one, so that a rule matches the path with or without it.
+func trimPath(path string) string {
+	return strings.TrimSuffix(trimSlash(path), "/")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package routes
+
+import "github.com/marigold-dev/tzproxy/tezos"
+
+// segmentTypes are the constraints a placeholder can put on a path segment,
+// by name. A placeholder named after a type, like {block}, uses that type.
+var segmentTypes = map[string]func(string) bool{
+	"any":      isAny,
+	"int":      isInt,
+	"hash":     tezos.IsBase58,
+	"chain":    isChain,
+	"block":    isBlock,
+	"head":     isHead,
+	"contract": isContract,
+}
+
+func isAny(s string) bool {
+	return s != ""
+}
+
+func isInt(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isChain matches main, test or a chain id such as NetXdQprcVkpaWU.
+func isChain(s string) bool {
+	return s == "main" || s == "test" || tezos.IsChainID(s)
+}
+
+// isBlock matches a block alias, level or hash, optionally followed by an
+// offset such as head~2.
+func isBlock(s string) bool {
+	_, ok := tezos.ParseBlockRef(s)
+	return ok
+}
+
+// isHead matches head, optionally followed by an offset such as head~2.
+func isHead(s string) bool {
+	ref, ok := tezos.ParseBlockRef(s)
+	return ok && ref.IsHead()
+}
+
+// isContract matches an implicit account, an originated contract or a smart
+// rollup address.
+func isContract(s string) bool {
+	if len(s) != 36 || !tezos.IsBase58(s) {
+		return false
+	}
+	switch s[:3] {
+	case "tz1", "tz2", "tz3", "tz4", "KT1", "sr1":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package routes
+
+import (
+	"fmt"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	typedSegment
+	catchAllSegment
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // literal value or type name
+}
+
+// parseSegments splits an anchored path into segments.
+func parseSegments(path string) ([]segment, error) {
+	parts := strings.Split(trimSlash(path), "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		switch {
+		case part == "**":
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("** must be the last segment")
+			}
+			segments = append(segments, segment{kind: catchAllSegment})
+		case part == "*":
+			segments = append(segments, segment{kind: typedSegment, value: "any"})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name, typ, typed := strings.Cut(part[1:len(part)-1], ":")
+			if name == "" {
+				return nil, fmt.Errorf("empty placeholder")
+			}
+			if !typed {
+				typ = name
+				if _, ok := segmentTypes[typ]; !ok {
+					typ = "any"
+				}
+			}
+			if _, ok := segmentTypes[typ]; !ok {
+				return nil, fmt.Errorf("unknown type %q in {%s}", typ, name)
+			}
+			segments = append(segments, segment{kind: typedSegment, value: typ})
+		case strings.ContainsAny(part, "{}*"):
+			return nil, fmt.Errorf("invalid segment %q", part)
+		default:
+			segments = append(segments, segment{kind: literalSegment, value: part})
+		}
+	}
+
+	return segments, nil
+}
+
+type node struct {
+	literals map[string]*node
+	typed    []typedChild
+	// rules ending at this node
+	rules []string
+	// rules ending at this node with **
+	catchAll []string
+}
+
+type typedChild struct {
+	typ   string
+	match func(string) bool
+	node  *node
+}
+
+func (n *node) insert(segments []segment, rule string) {
+	for _, s := range segments {
+		switch s.kind {
+		case catchAllSegment:
+			n.catchAll = append(n.catchAll, rule)
+			return
+		case literalSegment:
+			if n.literals == nil {
+				n.literals = map[string]*node{}
+			}
+			child, ok := n.literals[s.value]
+			if !ok {
+				child = &node{}
+				n.literals[s.value] = child
+			}
+			n = child
+		case typedSegment:
+			n = n.typedChild(s.value)
+		}
+	}
+	n.rules = append(n.rules, rule)
+}
+
+func (n *node) typedChild(typ string) *node {
+	for _, child := range n.typed {
+		if child.typ == typ {
+			return child.node
+		}
+	}
+	child := typedChild{typ: typ, match: segmentTypes[typ], node: &node{}}
+	n.typed = append(n.typed, child)
+	return child.node
+}
+
+// match walks the remaining segments of the path, literals first. It stops
+// at the first match unless matches is given, in which case every matching
+// rule is collected.
+func (n *node) match(path string, matches *[]string) bool {
+	found := n.collect(n.catchAll, matches)
+	if found && matches == nil {
+		return true
+	}
+
+	segment, rest, more := strings.Cut(path, "/")
+	if child, ok := n.literals[segment]; ok && child.next(rest, more, matches) {
+		if matches == nil {
+			return true
+		}
+		found = true
+	}
+	for _, child := range n.typed {
+		if child.match(segment) && child.node.next(rest, more, matches) {
+			if matches == nil {
+				return true
+			}
+			found = true
+		}
+	}
+
+	return found
+}
+
+// next continues the walk once a segment has been consumed.
+func (n *node) next(rest string, more bool, matches *[]string) bool {
+	if more {
+		return n.match(rest, matches)
+	}
+
+	// The path ends here, ** also matches no segment at all
+	found := n.collect(n.rules, matches)
+	if found && matches == nil {
+		return true
+	}
+	return n.collect(n.catchAll, matches) || found
+}
+
+func (n *node) collect(rules []string, matches *[]string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	if matches != nil {
+		*matches = append(*matches, rules...)
+	}
+	return true
+}
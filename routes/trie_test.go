@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	const hash = "BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2"
+	const contract = "KT1BEqzn5Wx8uJrZNvuS9DVHmLvG9td3fDLi"
+
+	tests := []struct {
+		name   string
+		rule   string
+		method string
+		path   string
+		want   bool
+	}{
+		// Anchoring
+		{"exact", "GET /version", "GET", "/version", true},
+		{"trailing slash", "GET /version", "GET", "/version/", true},
+		{"prefix", "GET /version", "GET", "/version/extra", false},
+		{"suffix", "GET /version", "GET", "/network/version", false},
+		{"other method", "GET /version", "POST", "/version", false},
+		{"any method", "* /version", "DELETE", "/version", true},
+		{"root", "GET /", "GET", "/", true},
+
+		// Placeholders
+		{"any", "GET /chains/{any}/chain_id", "GET", "/chains/anything/chain_id", true},
+		{"named", "GET /chains/{name}/chain_id", "GET", "/chains/anything/chain_id", true},
+		{"star", "GET /chains/*/chain_id", "GET", "/chains/anything/chain_id", true},
+		{"empty segment", "GET /chains/{any}/chain_id", "GET", "/chains//chain_id", false},
+		{"single segment", "GET /chains/*/chain_id", "GET", "/chains/a/b/chain_id", false},
+
+		// Typed constraints
+		{"int", "GET /blocks/{level:int}", "GET", "/blocks/1234", true},
+		{"not int", "GET /blocks/{level:int}", "GET", "/blocks/12a", false},
+		{"chain main", "GET /chains/{chain}/chain_id", "GET", "/chains/main/chain_id", true},
+		{"chain id", "GET /chains/{chain}/chain_id", "GET", "/chains/NetXdQprcVkpaWU/chain_id", true},
+		{"not chain", "GET /chains/{chain}/chain_id", "GET", "/chains/other/chain_id", false},
+		{"block head", "GET /blocks/{block}", "GET", "/blocks/head", true},
+		{"block offset", "GET /blocks/{block}", "GET", "/blocks/head~2", true},
+		{"block level", "GET /blocks/{block}", "GET", "/blocks/1234", true},
+		{"block hash", "GET /blocks/{block}", "GET", "/blocks/" + hash, true},
+		{"not block", "GET /blocks/{block}", "GET", "/blocks/latest", false},
+		{"head", "GET /blocks/{block:head}", "GET", "/blocks/head~1", true},
+		{"not head", "GET /blocks/{block:head}", "GET", "/blocks/1234", false},
+		{"contract", "GET /contracts/{contract}", "GET", "/contracts/" + contract, true},
+		{"not contract", "GET /contracts/{contract}", "GET", "/contracts/tz9xxx", false},
+
+		// Catch all
+		{"catch all", "GET /monitor/**", "GET", "/monitor/heads/main", true},
+		{"catch all one", "GET /monitor/**", "GET", "/monitor/bootstrapped", true},
+		{"catch all none", "GET /monitor/**", "GET", "/monitor", true},
+		{"catch all slash", "GET /monitor/**", "GET", "/monitor/", true},
+		{"catch all other", "GET /monitor/**", "GET", "/monitoring/heads", false},
+		{"catch all typed", "GET /chains/{chain}/blocks/{block}/**", "GET", "/chains/main/blocks/head/context/raw/json", true},
+		{"catch all typed mismatch", "GET /chains/{chain}/blocks/{block}/**", "GET", "/chains/main/blocks/latest/header", false},
+
+		// Regular expressions kept for compatibility
+		{"legacy", "GET/chains/.*/blocks", "GET", "/chains/main/blocks/head", true},
+		{"legacy method", "GET/chains/.*/blocks", "POST", "/chains/main/blocks/head", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := MustCompile(tt.rule)
+			if got := m.Match(tt.method, tt.path); got != tt.want {
+				t.Errorf("%q on %s %s = %v, want %v", tt.rule, tt.method, tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchLiteralsAndPlaceholders(t *testing.T) {
+	m := MustCompile(
+		"GET /chains/main/blocks/head/header",
+		"GET /chains/{chain}/blocks/{block}/hash",
+		"GET /chains/{any}/blocks/{any}/context/contracts",
+	)
+
+	// A literal child that doesn't lead to a match must not hide a
+	// placeholder that does.
+	if !m.Match("GET", "/chains/main/blocks/head/hash") {
+		t.Error("placeholder rule not matched after a literal prefix")
+	}
+	if !m.Match("GET", "/chains/main/blocks/unknown/context/contracts/") {
+		t.Error("any rule not matched with a trailing slash")
+	}
+	if m.Match("GET", "/chains/main/blocks/head/context") {
+		t.Error("rule matched a shorter path")
+	}
+
+	matches := m.Matches("GET", "/chains/main/blocks/head/header")
+	if len(matches) != 1 || matches[0] != "GET /chains/main/blocks/head/header" {
+		t.Errorf("Matches = %v", matches)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, rule := range []string{
+		"GET /monitor/**/heads",
+		"GET /chains/{}/blocks",
+		"GET /chains/{chain:unknown}/blocks",
+		"GET /chains/a*b",
+		"FETCH /version",
+		"GET[",
+	} {
+		if _, err := Compile([]string{rule}); err == nil {
+			t.Errorf("Compile(%q) succeeded", rule)
+		}
+	}
+}
+
+func TestNilMatcher(t *testing.T) {
+	var m *Matcher
+	if m.Match("GET", "/version") {
+		t.Error("nil Matcher matched")
+	}
+	if matches := m.Matches("GET", "/version"); len(matches) != 0 {
+		t.Errorf("nil Matcher Matches = %v", matches)
+	}
+}
+
+// benchmarkRules are the allowed routes of the default configuration, with
+// the regular expressions they replaced.
+var benchmarkRules = []struct {
+	rule  string
+	regex string
+}{
+	{"GET /chains/{chain}/blocks/**", "^/chains/.*/blocks"},
+	{"GET /chains/{chain}/chain_id", "^/chains/.*/chain_id$"},
+	{"GET /chains/{chain}/checkpoint", "^/chains/.*/checkpoint$"},
+	{"GET /chains/{chain}/invalid_blocks/**", "^/chains/.*/invalid_blocks"},
+	{"GET /chains/{chain}/is_bootstrapped", "^/chains/.*/is_bootstrapped$"},
+	{"GET /chains/{chain}/mempool/filter", "^/chains/.*/mempool/filter$"},
+	{"GET /chains/{chain}/mempool/monitor_operations", "^/chains/.*/mempool/monitor_operations$"},
+	{"GET /chains/{chain}/mempool/pending_operations", "^/chains/.*/mempool/pending_operations$"},
+	{"GET /config/network/user_activated_protocol_overrides", "^/config/network/user_activated_protocol_overrides$"},
+	{"GET /config/network/user_activated_upgrades", "^/config/network/user_activated_upgrades$"},
+	{"GET /config/network/dal", "^/config/network/dal$"},
+	{"GET /network/stat", "^/network/stat$"},
+	{"GET /network/version", "^/network/version$"},
+	{"GET /network/versions", "^/network/versions$"},
+	{"GET /protocols/**", "^/protocols"},
+	{"GET /monitor/**", "^/monitor"},
+	{"GET /version", "^/version$"},
+}
+
+var benchmarkPaths = []string{
+	"/chains/main/blocks/head/context/contracts/KT1BEqzn5Wx8uJrZNvuS9DVHmLvG9td3fDLi/balance",
+	"/chains/main/mempool/pending_operations",
+	"/monitor/heads/main",
+	"/version",
+	"/workers/prevalidators",
+}
+
+func BenchmarkMatcher(b *testing.B) {
+	rules := make([]string, len(benchmarkRules))
+	for i, r := range benchmarkRules {
+		rules[i] = r.rule
+	}
+	m := MustCompile(rules...)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range benchmarkPaths {
+			m.Match("GET", path)
+		}
+	}
+}
+
+func BenchmarkRegexpList(b *testing.B) {
+	regexes := make([]*regexp.Regexp, len(benchmarkRules))
+	for i, r := range benchmarkRules {
+		regexes[i] = regexp.MustCompile(r.regex)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range benchmarkPaths {
+			for _, regex := range regexes {
+				if regex.MatchString(path) {
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package tezos
+
+import (
+	"strconv"
+	"strings"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// BlockRef is a reference to a block: an alias, a level or a hash, followed
+// by an optional offset such as ~2 in head~2.
+type BlockRef struct {
+	Base string
+	// Offset is the separator followed by a number of blocks, ~ or - for
+	// blocks before the base and + for blocks after it
+	Offset string
+}
+
+// ParseBlockRef parses a block reference such as head, head~2, 1234 or a
+// block hash.
+func ParseBlockRef(s string) (BlockRef, bool) {
+	ref := BlockRef{Base: s}
+	if i := strings.LastIndexAny(s, "~+-"); i > 0 {
+		if _, err := strconv.ParseUint(s[i+1:], 10, 32); err == nil {
+			ref = BlockRef{Base: s[:i], Offset: s[i:]}
+		}
+	}
+
+	switch ref.Base {
+	case "head", "genesis", "caboose", "savepoint", "checkpoint":
+		return ref, true
+	}
+	return ref, IsLevel(ref.Base) || IsBlockHash(ref.Base)
+}
+
+// String returns the reference.
+func (r BlockRef) String() string {
+	return r.Base + r.Offset
+}
+
+// IsHead reports whether the block is relative to the head, such as head or
+// head~2.
+func (r BlockRef) IsHead() bool {
+	return r.Base == "head"
+}
+
+// Canonical returns the reference written in a single way, so that head-1
+// and head~01 become head~1, and head~0 becomes head.
+func (r BlockRef) Canonical() BlockRef {
+	if r.Offset == "" {
+		return r
+	}
+	n, err := strconv.ParseUint(r.Offset[1:], 10, 32)
+	if err != nil {
+		return r
+	}
+	if n == 0 {
+		return BlockRef{Base: r.Base}
+	}
+	separator := r.Offset[:1]
+	if separator == "-" {
+		separator = "~"
+	}
+	return BlockRef{Base: r.Base, Offset: separator + strconv.FormatUint(n, 10)}
+}
+
+// BlockPath is the path of an RPC under a block, such as
+// /chains/main/blocks/head~2/context/contracts.
+type BlockPath struct {
+	Chain string
+	Block BlockRef
+	// Rest is the part of the path after the block, with its leading slash
+	Rest string
+}
+
+// ParseBlockPath parses a path of the form /chains/{chain}/blocks/{block}
+// followed by any RPC of the block.
+func ParseBlockPath(path string) (BlockPath, bool) {
+	rest, ok := strings.CutPrefix(path, "/chains/")
+	if !ok {
+		return BlockPath{}, false
+	}
+	chain, rest, ok := strings.Cut(rest, "/")
+	if !ok || chain == "" {
+		return BlockPath{}, false
+	}
+	rest, ok = strings.CutPrefix(rest, "blocks/")
+	if !ok {
+		return BlockPath{}, false
+	}
+
+	block := rest
+	rest = ""
+	if i := strings.IndexByte(block, '/'); i >= 0 {
+		block, rest = block[:i], block[i:]
+	}
+	ref, ok := ParseBlockRef(block)
+	if !ok {
+		return BlockPath{}, false
+	}
+	return BlockPath{Chain: chain, Block: ref, Rest: rest}, true
+}
+
+// String returns the path.
+func (p BlockPath) String() string {
+	return "/chains/" + p.Chain + "/blocks/" + p.Block.String() + p.Rest
+}
+
+// WithBase returns the path with the base of the block replaced and its
+// offset kept, so that head~2 becomes <hash>~2.
+func (p BlockPath) WithBase(base string) BlockPath {
+	p.Block.Base = base
+	return p
+}
+
+// IsLevel reports whether s is a block level.
+func IsLevel(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsBlockHash reports whether s is a block hash, such as
+// BLockGenesisGenesisGenesisGenesisGenesisf79b5d1CoW2.
+func IsBlockHash(s string) bool {
+	return len(s) == 51 && s[0] == 'B' && IsBase58(s)
+}
+
+// IsChainID reports whether s is a chain id, such as NetXdQprcVkpaWU.
+func IsChainID(s string) bool {
+	return len(s) == 15 && strings.HasPrefix(s, "Net") && IsBase58(s)
+}
+
+// IsBase58 reports whether s is made of base58 characters only.
+func IsBase58(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(base58Alphabet, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
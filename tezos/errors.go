@@ -0,0 +1,110 @@
+package tezos
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Error kinds, telling whether the same request can succeed later.
+const (
+	KindTemporary = "temporary"
+	KindBranch    = "branch"
+	KindPermanent = "permanent"
+)
+
+// MaxErrorBytes is the size of the largest error body that is parsed.
+const MaxErrorBytes = 64 << 10
+
+// Error is an error of a Tezos RPC response, such as
+// {"kind":"temporary","id":"proto.alpha.contract.non_existing_contract"}.
+type Error struct {
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+}
+
+// Class returns the ID without the protocol of protocol errors, such as
+// contract.non_existing_contract, so that it doesn't change with the
+// protocol.
+func (e Error) Class() string {
+	if rest, ok := strings.CutPrefix(e.ID, "proto."); ok {
+		if _, class, ok := strings.Cut(rest, "."); ok {
+			return class
+		}
+	}
+	return e.ID
+}
+
+// Is reports whether the error has the given ID or class.
+func (e Error) Is(id string) bool {
+	return e.ID == id || e.Class() == id
+}
+
+// ParseErrors returns the errors of a response body, which is either a
+// list of errors or a single one, or nil when it holds none.
+func ParseErrors(body []byte) []Error {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+
+	var errs []Error
+	switch body[0] {
+	case '[':
+		if err := json.Unmarshal(body, &errs); err != nil {
+			return nil
+		}
+	case '{':
+		var e Error
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil
+		}
+		errs = []Error{e}
+	default:
+		return nil
+	}
+
+	parsed := errs[:0]
+	for _, e := range errs {
+		if e.ID != "" {
+			parsed = append(parsed, e)
+		}
+	}
+	if len(parsed) == 0 {
+		return nil
+	}
+	return parsed
+}
+
+// ReadErrors parses the errors of an error response, and puts back its body
+// for the next reader. Only JSON bodies up to MaxErrorBytes are read.
+func ReadErrors(res *http.Response) []Error {
+	if res.StatusCode < http.StatusBadRequest || res.Body == nil || res.Body == http.NoBody ||
+		res.ContentLength > MaxErrorBytes ||
+		!strings.Contains(res.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, MaxErrorBytes+1))
+	res.Body = &replayBody{Reader: io.MultiReader(bytes.NewReader(body), res.Body), Closer: res.Body}
+	if err != nil || len(body) > MaxErrorBytes {
+		return nil
+	}
+	return ParseErrors(body)
+}
+
+// IDs returns the IDs of the errors, for logging.
+func IDs(errs []Error) []string {
+	ids := make([]string, 0, len(errs))
+	for _, e := range errs {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
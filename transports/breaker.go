@@ -0,0 +1,63 @@
+package transports
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/breaker"
+	"github.com/marigold-dev/tzproxy/concurrency"
+	"github.com/marigold-dev/tzproxy/tezos"
+)
+
+// breakerTransport reports the outcome of every request to the circuit
+// breaker of its host. Transport errors, timeouts, gateway errors and
+// temporary Tezos errors count as failures; client cancellations, local
+// limits and other Tezos errors, caused by the request, don't. The probe of
+// a half-open breaker is released when the outcome isn't recorded.
+type breakerTransport struct {
+	next     http.RoundTripper
+	breakers *breaker.Set
+}
+
+func NewBreakerTransport(next http.RoundTripper, breakers *breaker.Set) http.RoundTripper {
+	return &breakerTransport{
+		next:     next,
+		breakers: breakers,
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+
+	switch {
+	case err != nil:
+		if errors.Is(err, context.Canceled) || errors.Is(err, concurrency.ErrLimitReached) {
+			t.breakers.Release(req.URL.Host)
+		} else {
+			t.breakers.Record(req.URL.Host, true, latency)
+		}
+	case res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout:
+		t.breakers.Record(req.URL.Host, true, latency)
+	case res.StatusCode == http.StatusInternalServerError:
+		t.breakers.Record(req.URL.Host, hasTemporaryError(tezos.ReadErrors(res)), latency)
+	default:
+		t.breakers.Record(req.URL.Host, false, latency)
+	}
+
+	return res, err
+}
+
+func hasTemporaryError(errs []tezos.Error) bool {
+	for _, e := range errs {
+		if e.Kind == tezos.KindTemporary {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package transports
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/concurrency"
+)
+
+// concurrencyTransport caps the number of in-flight requests per upstream
+// host. The slot is held until the response body is closed, so streaming
+// responses keep counting for as long as they are open.
+type concurrencyTransport struct {
+	next         http.RoundTripper
+	limiter      *concurrency.Limiter
+	queueTimeout time.Duration
+}
+
+func NewConcurrencyTransport(next http.RoundTripper, limiter *concurrency.Limiter, queueTimeout time.Duration) http.RoundTripper {
+	return &concurrencyTransport{
+		next:         next,
+		limiter:      limiter,
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (t *concurrencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if err := t.limiter.Acquire(req.Context(), host, t.queueTimeout); err != nil {
+		return nil, err
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.limiter.Release(host)
+		return nil, err
+	}
+
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: func() {
+		t.limiter.Release(host)
+	}}
+	return res, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	closed  bool
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	if !r.closed {
+		r.closed = true
+		r.release()
+	}
+	return err
+}
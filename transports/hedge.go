@@ -0,0 +1,120 @@
+package transports
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+)
+
+type hedgeTransport struct {
+	next        http.RoundTripper
+	delay       time.Duration
+	alternative func() *url.URL
+	answered    func(target *url.URL)
+	observe     func(latency time.Duration)
+}
+
+type hedgeResult struct {
+	leg int
+	res *http.Response
+	err error
+}
+
+// NewHedgeTransport sends the request again to the alternative target when
+// the first one hasn't answered within the delay. The first response is
+// used and the other request is canceled; an error only counts once both
+// requests failed. alternative is called when the delay is over, and may
+// return nil when no other target is available. answered is called with
+// the target of the response used.
+//
+// observe is called with the latency of the first request only, since the
+// delay derives from it: the time it took to answer, or when the other
+// request answered first, the time it had waited when it was canceled. It
+// isn't called when the first request failed.
+func NewHedgeTransport(next http.RoundTripper, delay time.Duration, alternative func() *url.URL, answered func(*url.URL), observe func(time.Duration)) http.RoundTripper {
+	return &hedgeTransport{next: next, delay: delay, alternative: alternative, answered: answered, observe: observe}
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	results := make(chan hedgeResult, 2)
+	targets := []*url.URL{}
+	contexts := []context.Context{}
+	cancels := []context.CancelFunc{}
+	send := func(r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		leg := len(cancels)
+		targets = append(targets, r.URL)
+		contexts = append(contexts, ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			res, err := t.next.RoundTrip(r.WithContext(ctx))
+			results <- hedgeResult{leg: leg, res: res, err: err}
+		}()
+	}
+	send(req)
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+	var err error
+	firstFailed := false
+	for received := 0; received < len(cancels); {
+		select {
+		case <-timer.C:
+			alternative := t.alternative()
+			if alternative == nil {
+				continue
+			}
+			hedge := req.Clone(req.Context())
+			hedge.URL.Scheme = alternative.Scheme
+			hedge.URL.Host = alternative.Host
+			send(hedge)
+		case result := <-results:
+			received++
+			if result.err != nil {
+				err = result.err
+				firstFailed = firstFailed || result.leg == 0
+				continue
+			}
+
+			for leg, cancel := range cancels {
+				if leg != result.leg {
+					cancel()
+				}
+			}
+			// The response of the other request, if any, is discarded
+			go func(left int) {
+				for ; left > 0; left-- {
+					if other := <-results; other.res != nil {
+						other.res.Body.Close()
+					}
+				}
+			}(len(cancels) - received)
+
+			if len(cancels) > 1 {
+				winner := "first"
+				if result.leg > 0 {
+					winner = "hedge"
+				}
+				metrics.HedgedRequests.WithLabelValues(winner).Inc()
+			}
+			if !firstFailed {
+				t.observe(time.Since(start))
+			}
+			t.answered(targets[result.leg])
+			result.res.Body = &cancelOnClose{ReadCloser: result.res.Body, ctx: contexts[result.leg], cancel: cancels[result.leg]}
+			return result.res, nil
+		}
+	}
+
+	if len(cancels) > 1 {
+		metrics.HedgedRequests.WithLabelValues("none").Inc()
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, err
+}
@@ -0,0 +1,148 @@
+package transports
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstream answers after its delay, or fails when it has an error.
+type upstream struct {
+	delay time.Duration
+	err   error
+}
+
+// fakeTransport answers the requests as the upstream of their host, and
+// records the requests canceled before their answer.
+type fakeTransport struct {
+	upstreams map[string]upstream
+	mutex     sync.Mutex
+	canceled  map[string]bool
+}
+
+func (t *fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	up := t.upstreams[req.URL.Host]
+	select {
+	case <-time.After(up.delay):
+	case <-req.Context().Done():
+		t.mutex.Lock()
+		t.canceled[req.URL.Host] = true
+		t.mutex.Unlock()
+		return nil, req.Context().Err()
+	}
+	if up.err != nil {
+		return nil, up.err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(req.URL.Host)),
+		Request:    req,
+	}, nil
+}
+
+func (t *fakeTransport) wasCanceled(host string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.canceled[host]
+}
+
+func TestHedgeTransport(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	const slow = time.Second
+	errRefused := errors.New("connection refused")
+
+	tests := []struct {
+		name        string
+		first       upstream
+		hedge       upstream
+		alternative bool
+		// answered is the host expected to answer, none when the request
+		// fails
+		answered string
+		canceled string
+		// observed is the minimum latency expected for the first leg, -1
+		// when it isn't observed
+		observed time.Duration
+	}{
+		{name: "first leg before the delay", first: upstream{}, hedge: upstream{}, alternative: true, answered: "first", observed: 0},
+		{name: "first leg after the delay", first: upstream{delay: 2 * delay}, hedge: upstream{delay: slow}, alternative: true, answered: "first", canceled: "hedge", observed: 2 * delay},
+		{name: "hedge", first: upstream{delay: slow}, hedge: upstream{delay: delay}, alternative: true, answered: "hedge", canceled: "first", observed: 2 * delay},
+		{name: "first leg failed", first: upstream{delay: 2 * delay, err: errRefused}, hedge: upstream{delay: 2 * delay}, alternative: true, answered: "hedge", observed: -1},
+		{name: "both failed", first: upstream{delay: 2 * delay, err: errRefused}, hedge: upstream{err: errRefused}, alternative: true, observed: -1},
+		{name: "no alternative", first: upstream{delay: 2 * delay}, answered: "first", observed: 2 * delay},
+		{name: "no alternative and failed", first: upstream{delay: 2 * delay, err: errRefused}, observed: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &fakeTransport{
+				upstreams: map[string]upstream{"first": tt.first, "hedge": tt.hedge},
+				canceled:  map[string]bool{},
+			}
+			alternatives := 0
+			answered := ""
+			observed := time.Duration(-1)
+			transport := NewHedgeTransport(next, delay,
+				func() *url.URL {
+					alternatives++
+					if !tt.alternative {
+						return nil
+					}
+					return &url.URL{Scheme: "http", Host: "hedge"}
+				},
+				func(target *url.URL) {
+					answered = target.Host
+				},
+				func(latency time.Duration) {
+					observed = latency
+				})
+
+			req := httptest.NewRequest(http.MethodGet, "http://first/chains/main/blocks/head/header", nil)
+			res, err := transport.RoundTrip(req)
+			if tt.observed < 0 && observed >= 0 {
+				t.Errorf("first leg observed with %v", observed)
+			} else if observed < tt.observed || observed >= slow {
+				t.Errorf("first leg observed with %v, want at least %v", observed, tt.observed)
+			}
+			if tt.answered == "" {
+				if err == nil {
+					t.Fatal("the request succeeded")
+				}
+				if answered != "" {
+					t.Errorf("answered by %s", answered)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(body) != tt.answered || answered != tt.answered {
+				t.Errorf("response from %s, answered by %s, want %s", body, answered, tt.answered)
+			}
+			if tt.first.delay < delay && alternatives > 0 {
+				t.Error("hedged before the delay")
+			}
+			if tt.canceled != "" {
+				deadline := time.Now().Add(time.Second)
+				for !next.wasCanceled(tt.canceled) && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if !next.wasCanceled(tt.canceled) {
+					t.Errorf("the request to %s is not canceled", tt.canceled)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package transports
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+)
+
+var ErrResponseTooLarge = errors.New("upstream response is too large")
+
+// responseLimitTransport caps the size of upstream responses. Responses
+// announcing a larger Content-Length are refused before anything is sent to
+// the client; the others fail once they go past the limit, which aborts the
+// client connection instead of silently truncating the body.
+type responseLimitTransport struct {
+	next  http.RoundTripper
+	limit func(req *http.Request) int64
+}
+
+// NewResponseLimitTransport limits responses to limit(req) bytes, 0 meaning
+// no limit.
+func NewResponseLimitTransport(next http.RoundTripper, limit func(req *http.Request) int64) http.RoundTripper {
+	return &responseLimitTransport{
+		next:  next,
+		limit: limit,
+	}
+}
+
+func (t *responseLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := t.limit(req)
+	if limit <= 0 {
+		return res, nil
+	}
+	if res.ContentLength > limit {
+		res.Body.Close()
+		metrics.ResponsesTooLarge.Inc()
+		return nil, ErrResponseTooLarge
+	}
+
+	res.Body = &limitedBody{ReadCloser: res.Body, remaining: limit}
+	return res, nil
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		metrics.ResponsesTooLarge.Inc()
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
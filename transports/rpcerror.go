@@ -0,0 +1,30 @@
+package transports
+
+import (
+	"net/http"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+	"github.com/marigold-dev/tzproxy/tezos"
+)
+
+// rpcErrorTransport counts the Tezos errors of the error responses by kind
+// and class.
+type rpcErrorTransport struct {
+	next http.RoundTripper
+}
+
+func NewRPCErrorTransport(next http.RoundTripper) http.RoundTripper {
+	return &rpcErrorTransport{next: next}
+}
+
+func (t *rpcErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	for _, e := range tezos.ReadErrors(res) {
+		metrics.RPCErrors.WithLabelValues(e.Kind, e.Class()).Inc()
+	}
+	return res, nil
+}
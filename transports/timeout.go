@@ -0,0 +1,123 @@
+package transports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/marigold-dev/tzproxy/metrics"
+)
+
+var ErrUpstreamTimeout = errors.New("upstream request timed out")
+
+// ErrConnectTimeout is wrapped with ErrUpstreamTimeout when the connection
+// to the node timed out, before the request was sent.
+var ErrConnectTimeout = errors.New("connect")
+
+var (
+	errHeaderTimeout = errors.New("response header timeout")
+	errTotalTimeout  = errors.New("total timeout")
+)
+
+// timeoutTransport bounds the time to get the response headers and the time
+// of the whole exchange, body included. Requests are derived from the client
+// request context, so a client disconnect also cancels the upstream request.
+type timeoutTransport struct {
+	next     http.RoundTripper
+	timeouts func(req *http.Request) (header, total time.Duration)
+}
+
+// NewTimeoutTransport applies the timeouts returned for each request, 0
+// meaning no timeout. Timed out requests fail with ErrUpstreamTimeout.
+func NewTimeoutTransport(next http.RoundTripper, timeouts func(req *http.Request) (header, total time.Duration)) http.RoundTripper {
+	return &timeoutTransport{
+		next:     next,
+		timeouts: timeouts,
+	}
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	header, total := t.timeouts(req)
+	ctx, cancel := context.WithCancelCause(req.Context())
+
+	stopTotal := func() bool { return false }
+	if total > 0 {
+		stopTotal = time.AfterFunc(total, func() { cancel(errTotalTimeout) }).Stop
+	}
+	stopHeader := func() bool { return false }
+	if header > 0 {
+		stopHeader = time.AfterFunc(header, func() { cancel(errHeaderTimeout) }).Stop
+	}
+
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	stopHeader()
+	if err == nil && context.Cause(ctx) == errHeaderTimeout {
+		// The timer fired right after the headers arrived
+		res.Body.Close()
+		err = context.Cause(ctx)
+	}
+	if err != nil {
+		stopTotal()
+		cause := context.Cause(ctx)
+		cancel(nil)
+		return nil, timeoutError(err, cause)
+	}
+
+	res.Body = &cancelOnClose{ReadCloser: res.Body, ctx: ctx, cancel: func() {
+		stopTotal()
+		cancel(nil)
+	}}
+	return res, nil
+}
+
+// timeoutError replaces the errors caused by a timeout with
+// ErrUpstreamTimeout, and counts them by phase.
+func timeoutError(err, cause error) error {
+	phase := ""
+	var netErr net.Error
+	switch {
+	case cause == errHeaderTimeout:
+		phase = "header"
+	case cause == errTotalTimeout:
+		phase = "total"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		// Dial and TLS handshake timeouts
+		phase = "connect"
+	default:
+		return err
+	}
+
+	metrics.UpstreamTimeouts.WithLabelValues(phase).Inc()
+	if phase == "connect" {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, ErrConnectTimeout)
+	}
+	return fmt.Errorf("%w: %s", ErrUpstreamTimeout, phase)
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel func()
+	closed bool
+}
+
+func (b *cancelOnClose) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = timeoutError(err, context.Cause(b.ctx))
+	}
+	return n, err
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.closed {
+		b.closed = true
+		b.cancel()
+	}
+	return err
+}
@@ -0,0 +1,45 @@
+package transports
+
+import (
+	"errors"
+	"testing"
+)
+
+// netTimeout is a net.Error that timed out.
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestTimeoutError(t *testing.T) {
+	refused := errors.New("connection refused")
+
+	tests := []struct {
+		name    string
+		err     error
+		cause   error
+		timeout bool
+		connect bool
+	}{
+		{name: "connect", err: netTimeout{}, timeout: true, connect: true},
+		{name: "header", err: errors.New("context canceled"), cause: errHeaderTimeout, timeout: true},
+		{name: "total", err: errors.New("context canceled"), cause: errTotalTimeout, timeout: true},
+		{name: "other error", err: refused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := timeoutError(tt.err, tt.cause)
+			if got := errors.Is(err, ErrUpstreamTimeout); got != tt.timeout {
+				t.Errorf("timeout = %v, want %v", got, tt.timeout)
+			}
+			if got := errors.Is(err, ErrConnectTimeout); got != tt.connect {
+				t.Errorf("connect timeout = %v, want %v", got, tt.connect)
+			}
+			if !tt.timeout && err != tt.err {
+				t.Errorf("error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}